@@ -3,6 +3,7 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"log"
@@ -10,55 +11,100 @@ import (
 	"os"
 
 	"cloud.google.com/go/pubsub"
-	minio "github.com/minio/minio-go"
 	"github.com/wkharold/fileup/pkg/archiver"
+	"github.com/wkharold/fileup/pkg/blob"
+	"github.com/wkharold/fileup/pkg/bus"
 	"github.com/wkharold/fileup/pkg/cmd"
+	"github.com/wkharold/fileup/pkg/crypto"
+	"github.com/wkharold/fileup/pkg/objectstore"
 	"github.com/wkharold/fileup/pkg/satokensource"
 	"github.com/wkharold/fileup/pkg/sdlog"
-	"golang.org/x/oauth2"
+	"github.com/wkharold/fileup/pkg/tokensource"
 	"golang.org/x/oauth2/google"
 	iam "google.golang.org/api/iam/v1"
-	"google.golang.org/api/option"
 )
 
 const (
+	podNameEnvVar    = "POD_NAME"
+	bucketNameEnvVar = "MINIO_BUCKET"
+
 	accessKeyIDEnvVar     = "MINIO_ACCESSKEYID"
-	podNameEnvVar         = "POD_NAME"
 	secretAccessKeyEnvVar = "MINIO_SECRETKEY"
 
-	location = "us-east-1"
-	logname  = "archiver_log"
-	noprefix = ""
+	azureAccountEnvVar = "AZURE_STORAGE_ACCOUNT"
+	azureKeyEnvVar     = "AZURE_STORAGE_KEY"
+
+	b2AccountIDEnvVar = "B2_ACCOUNT_ID"
+	b2AppKeyEnvVar    = "B2_APPLICATION_KEY"
+
+	archiveAccessKeyIDEnvVar     = "ARCHIVE_MINIO_ACCESSKEYID"
+	archiveSecretAccessKeyEnvVar = "ARCHIVE_MINIO_SECRETKEY"
+
+	archiveAzureAccountEnvVar = "ARCHIVE_AZURE_STORAGE_ACCOUNT"
+	archiveAzureKeyEnvVar     = "ARCHIVE_AZURE_STORAGE_KEY"
+
+	archiveB2AccountIDEnvVar = "ARCHIVE_B2_ACCOUNT_ID"
+	archiveB2AppKeyEnvVar    = "ARCHIVE_B2_APPLICATION_KEY"
+
+	sseCustomerKeyEnvVar        = "SSE_CUSTOMER_KEY"
+	archiveSSECustomerKeyEnvVar = "ARCHIVE_SSE_CUSTOMER_KEY"
+
+	logname = "archiver_log"
 )
 
 var (
 	ctx = context.Background()
 
-	labeledtopic   = flag.String("labeledtopic", "", "PubSub topic for labeled notifications (Required)")
-	bucket         = flag.String("bucket", "", "Cloud storage archive bucket (Required)")
-	filestore      = flag.String("filestore", "", "Endpoint for uploaded files (Required)")
-	projectid      = flag.String("projectid", "", "Project ID of the project hosting the application (Required)")
-	serviceaccount = flag.String("serviceaccount", "", "Service account to use of publishing (Required)")
-	targetlabel    = flag.String("targetlabel", "cat", "Target label for images to archive")
+	labeledtopic    = flag.String("labeledtopic", "", "PubSub topic for labeled notifications (Required)")
+	bucket          = flag.String("bucket", "", "Archive bucket (Required)")
+	filestore       = flag.String("filestore", "", "Endpoint for uploaded files (Required if --backend=minio)")
+	archivestore    = flag.String("archivestore", "", "Endpoint for the archive store (Required if --archivebackend=minio)")
+	projectid       = flag.String("projectid", "", "Project ID of the project hosting the application (Required)")
+	serviceaccount  = flag.String("serviceaccount", "", "Service account to use of publishing (Required)")
+	targetlabel     = flag.String("targetlabel", "cat", "Target label for images to archive")
+	kmskey          = flag.String("kmskey", "", "KMS key resource name to decrypt archived uploads with (passthrough if empty)")
+	backend         = flag.String("backend", objectstore.MinIO, "Object store backend for uploaded files (minio|gcs|azure|b2)")
+	archivebackend  = flag.String("archivebackend", objectstore.GCS, "Object store backend for the archive (minio|gcs|azure|b2)")
+	storeurl        = flag.String("storeurl", "", "Single-URL form of the source store (e.g. gs://..., s3://user:pass@host, minio://..., azure://..., b2://...); overrides --backend and its related flags/env vars when set")
+	archivestoreurl = flag.String("archivestoreurl", "", "Single-URL form of the archive store; overrides --archivebackend and its related flags/env vars when set")
+	busKind         = flag.String("bus", bus.PubSub, "Message bus backend to use (pubsub|mqtt)")
+	mqttBroker      = flag.String("mqttbroker", "", "MQTT broker address host:port (Required if --bus=mqtt)")
+
+	tokensourcemode    = flag.String("tokensourcemode", "", "OAuth2 token source mode for GCP auth: signjwt (default), adc, jwtfile, or externalaccount")
+	tokensourcekeyfile = flag.String("tokensourcekeyfile", "", "Key file for --tokensourcemode=jwtfile|externalaccount (default GOOGLE_APPLICATION_CREDENTIALS)")
+
+	ministsendpoint        = flag.String("ministsendpoint", "", "MinIO STS endpoint to exchange a signed JWT for scoped read credentials (bypasses MINIO_ACCESSKEYID/MINIO_SECRETKEY)")
+	archiveministsendpoint = flag.String("archiveministsendpoint", "", "MinIO STS endpoint to exchange a signed JWT for scoped archive write credentials (bypasses ARCHIVE_MINIO_ACCESSKEYID/ARCHIVE_MINIO_SECRETKEY)")
+
+	sseMode     = flag.String("sse-mode", "", "Server-side encryption protecting source objects (none|sse-s3|sse-c|sse-kms, empty disables it)")
+	sseKMSKeyID = flag.String("sse-kms-key-id", "", "KMS key resource name for --sse-mode=sse-kms")
 
-	accessKeyID     = cmd.MustGetenv(accessKeyIDEnvVar)
-	podName         = cmd.MustGetenv(podNameEnvVar)
-	secretAccessKey = cmd.MustGetenv(secretAccessKeyEnvVar)
+	archiveSSEMode     = flag.String("archive-sse-mode", "", "Server-side encryption to apply to archived objects (none|sse-s3|sse-c|sse-kms, empty disables it)")
+	archiveSSEKMSKeyID = flag.String("archive-sse-kms-key-id", "", "KMS key resource name for --archive-sse-mode=sse-kms")
+
+	verifyarchive = flag.Bool("verifyarchive", false, "Re-fetch and re-decrypt each archived copy to verify its SHA-256 against the source before reporting success (costs a second read-back, and a second KMS Decrypt under SSE-KMS, per archived object)")
+
+	podName = cmd.MustGetenv(podNameEnvVar)
 
 	logger      *sdlog.StackdriverLogger
-	mc          *minio.Client
+	store       objectstore.Store
+	dst         objectstore.Store
 	subcription string
 )
 
 func prestop(w http.ResponseWriter, r *http.Request) {
-	client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
+	ts, err := satokensource.TokenSourceOption(ctx, satokensource.Config{
+		Mode:           satokensource.Mode(*tokensourcemode),
+		Logger:         logger,
+		ProjectID:      *projectid,
+		ServiceAccount: *serviceaccount,
+		KeyFile:        *tokensourcekeyfile,
+	})
 	if err != nil {
-		logger.LogError("Unable to get application default client", err)
+		logger.LogError("Unable to create OAuth2 token source", err)
 		return
 	}
 
-	ts := option.WithTokenSource(oauth2.ReuseTokenSource(nil, satokensource.New(client, logger, *projectid, *serviceaccount)))
-
 	pc, err := pubsub.NewClient(ctx, *projectid, ts)
 	if err != nil {
 		logger.LogError("Unable to create PubSub client", err)
@@ -77,10 +123,159 @@ func prestop(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func newStore(logger *sdlog.StackdriverLogger) (objectstore.Store, error) {
+	if *storeurl != "" {
+		return blob.Open(ctx, *storeurl, logger, satokensource.Mode(*tokensourcemode), *tokensourcekeyfile)
+	}
+
+	cfg := objectstore.Config{
+		Kind:               *backend,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	}
+
+	switch *backend {
+	case objectstore.GCS:
+	case objectstore.Azure:
+		cfg.AzureAccount = cmd.MustGetenv(azureAccountEnvVar)
+		cfg.AzureKey = cmd.MustGetenv(azureKeyEnvVar)
+	case objectstore.B2:
+		cfg.B2AccountID = cmd.MustGetenv(b2AccountIDEnvVar)
+		cfg.B2ApplicationKey = cmd.MustGetenv(b2AppKeyEnvVar)
+	default:
+		if len(*filestore) == 0 {
+			log.Fatalf("--filestore must be set for the %s backend", objectstore.MinIO)
+		}
+		cfg.Endpoint = *filestore
+
+		if len(*ministsendpoint) > 0 {
+			client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
+			if err != nil {
+				return nil, err
+			}
+
+			cfg.MinIOSTSEndpoint = *ministsendpoint
+			cfg.MinIOSTSSigner = tokensource.NewGCPSigner(client, *projectid, *serviceaccount)
+			cfg.MinIOSTSPolicy = tokensource.ActionPolicy(localBucket(), "s3:GetObject", "s3:ListBucket")
+		} else {
+			cfg.AccessKeyID = cmd.MustGetenv(accessKeyIDEnvVar)
+			cfg.SecretAccessKey = cmd.MustGetenv(secretAccessKeyEnvVar)
+		}
+	}
+
+	return objectstore.New(ctx, cfg)
+}
+
+// localBucket returns the source bucket archiver reads from, used to scope MinIO STS
+// credentials; it falls back to a wildcard if MINIO_BUCKET isn't set, since the archiver's
+// source bucket name otherwise arrives per-message rather than as a fixed flag.
+func localBucket() string {
+	if b := os.Getenv(bucketNameEnvVar); b != "" {
+		return b
+	}
+
+	return "*"
+}
+
+// newArchiveStore opens the archiver's destination store, which is
+// configured and authenticated independently of the source store so an
+// operator can, for example, receive into MinIO and archive into B2.
+func newArchiveStore(logger *sdlog.StackdriverLogger) (objectstore.Store, error) {
+	if *archivestoreurl != "" {
+		return blob.Open(ctx, *archivestoreurl, logger, satokensource.Mode(*tokensourcemode), *tokensourcekeyfile)
+	}
+
+	cfg := objectstore.Config{
+		Kind:               *archivebackend,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	}
+
+	switch *archivebackend {
+	case objectstore.GCS:
+	case objectstore.Azure:
+		cfg.AzureAccount = cmd.MustGetenv(archiveAzureAccountEnvVar)
+		cfg.AzureKey = cmd.MustGetenv(archiveAzureKeyEnvVar)
+	case objectstore.B2:
+		cfg.B2AccountID = cmd.MustGetenv(archiveB2AccountIDEnvVar)
+		cfg.B2ApplicationKey = cmd.MustGetenv(archiveB2AppKeyEnvVar)
+	default:
+		if len(*archivestore) == 0 {
+			log.Fatalf("--archivestore must be set for the %s archive backend", objectstore.MinIO)
+		}
+		cfg.Endpoint = *archivestore
+
+		if len(*archiveministsendpoint) > 0 {
+			client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
+			if err != nil {
+				return nil, err
+			}
+
+			cfg.MinIOSTSEndpoint = *archiveministsendpoint
+			cfg.MinIOSTSSigner = tokensource.NewGCPSigner(client, *projectid, *serviceaccount)
+			cfg.MinIOSTSPolicy = tokensource.ActionPolicy(*bucket, "s3:PutObject")
+		} else {
+			cfg.AccessKeyID = cmd.MustGetenv(archiveAccessKeyIDEnvVar)
+			cfg.SecretAccessKey = cmd.MustGetenv(archiveSecretAccessKeyEnvVar)
+		}
+	}
+
+	return objectstore.New(ctx, cfg)
+}
+
+// newSSEConfig builds the objectstore.SSEConfig described by --sse-mode, reading the customer
+// key for --sse-mode=sse-c from SSE_CUSTOMER_KEY (base64-encoded, never a flag). It must match
+// the configuration the receiver used to write the source object.
+func newSSEConfig() (objectstore.SSEConfig, error) {
+	cfg := objectstore.SSEConfig{Mode: objectstore.SSEMode(*sseMode), KMSKeyID: *sseKMSKeyID}
+	if cfg.Mode == "none" {
+		cfg.Mode = objectstore.SSENone
+	}
+
+	if cfg.Mode != objectstore.SSEC {
+		return cfg, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(cmd.MustGetenv(sseCustomerKeyEnvVar))
+	if err != nil {
+		return objectstore.SSEConfig{}, fmt.Errorf("unable to decode %s: %+v", sseCustomerKeyEnvVar, err)
+	}
+	cfg.CustomerKey = key
+
+	return cfg, nil
+}
+
+// newArchiveSSEConfig is newSSEConfig's counterpart for --archive-sse-mode, the server-side
+// encryption writeToCloud applies to the archive copy.
+func newArchiveSSEConfig() (objectstore.SSEConfig, error) {
+	cfg := objectstore.SSEConfig{Mode: objectstore.SSEMode(*archiveSSEMode), KMSKeyID: *archiveSSEKMSKeyID}
+	if cfg.Mode == "none" {
+		cfg.Mode = objectstore.SSENone
+	}
+
+	if cfg.Mode != objectstore.SSEC {
+		return cfg, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(cmd.MustGetenv(archiveSSECustomerKeyEnvVar))
+	if err != nil {
+		return objectstore.SSEConfig{}, fmt.Errorf("unable to decode %s: %+v", archiveSSECustomerKeyEnvVar, err)
+	}
+	cfg.CustomerKey = key
+
+	return cfg, nil
+}
+
 func main() {
 	flag.Parse()
 
-	if len(*bucket) == 0 || len(*filestore) == 0 || len(*projectid) == 0 || len(*labeledtopic) == 0 || len(*serviceaccount) == 0 || len(*targetlabel) == 0 {
+	if len(*bucket) == 0 || len(*projectid) == 0 || len(*labeledtopic) == 0 || len(*serviceaccount) == 0 || len(*targetlabel) == 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
@@ -92,14 +287,48 @@ func main() {
 		log.Fatalf("unable to create Stackdriver logger [%+v]", err)
 	}
 
-	mc, err = minio.New(*filestore, accessKeyID, secretAccessKey, false)
+	store, err = newStore(logger)
 	if err != nil {
 		log.Fatalf("unable to connect to file store: %+v\n", err)
 	}
 
+	dst, err = newArchiveStore(logger)
+	if err != nil {
+		log.Fatalf("unable to connect to archive store: %+v\n", err)
+	}
+
 	subcription = fmt.Sprintf("%s+%s", podName, *targetlabel)
 
-	archiver, err := archiver.New(logger, mc, *projectid, *serviceaccount, *bucket, *labeledtopic, subcription, *targetlabel)
+	b, err := bus.New(ctx, bus.Config{
+		Kind:               *busKind,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		MQTTBroker:         *mqttBroker,
+		MQTTClientID:       "archiver",
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	})
+	if err != nil {
+		log.Fatalf("message bus creation failed: %+v\n", err)
+	}
+
+	enc, err := crypto.New(logger, *projectid, *serviceaccount, *kmskey, satokensource.Mode(*tokensourcemode), *tokensourcekeyfile)
+	if err != nil {
+		log.Fatalf("encryptor creation failed: %+v\n", err)
+	}
+
+	srcSSE, err := newSSEConfig()
+	if err != nil {
+		log.Fatalf("unable to configure server-side encryption: %+v\n", err)
+	}
+
+	dstSSE, err := newArchiveSSEConfig()
+	if err != nil {
+		log.Fatalf("unable to configure archive server-side encryption: %+v\n", err)
+	}
+
+	archiver, err := archiver.New(logger, store, enc, srcSSE, dst, dstSSE, b, *bucket, *labeledtopic, subcription, *targetlabel, *verifyarchive)
 	if err != nil {
 		log.Fatalf("recognizer creation failed [%+v]", err)
 	}
@@ -107,7 +336,7 @@ func main() {
 	go func() {
 		http.HandleFunc("/_alive", cmd.Liveness)
 		http.HandleFunc("/_prestop", prestop)
-		http.HandleFunc("/_ready", cmd.Readiness)
+		http.HandleFunc("/_ready", cmd.Readiness())
 
 		http.ListenAndServe(":8080", nil)
 	}()
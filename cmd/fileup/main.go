@@ -1,125 +1,251 @@
+// Implements the uploader microservice binary.
 package main
 
 import (
 	"context"
-	"encoding/json"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 
-	minio "github.com/minio/minio-go"
+	"github.com/wkharold/fileup/pkg/auth"
+	"github.com/wkharold/fileup/pkg/blob"
+	"github.com/wkharold/fileup/pkg/bus"
 	"github.com/wkharold/fileup/pkg/cmd"
+	"github.com/wkharold/fileup/pkg/objectstore"
+	"github.com/wkharold/fileup/pkg/retry"
+	"github.com/wkharold/fileup/pkg/satokensource"
 	"github.com/wkharold/fileup/pkg/sdlog"
+	"github.com/wkharold/fileup/pkg/tokensource"
 	"github.com/wkharold/fileup/pkg/uploader"
+	"golang.org/x/oauth2/google"
+	iam "google.golang.org/api/iam/v1"
 )
 
-type Env struct {
-	projectId      string
-	serviceAccount string
-	topic          string
-}
-
-type FileDesc struct {
-	Name string `json:"name"`
-	Size int64  `json:"size"`
-}
-
 const (
+	bucketNameEnvVar = "MINIO_BUCKET"
+
 	accessKeyIdEnvVar     = "MINIO_ACCESSKEYID"
-	bucketNameEnvVar      = "MINIO_BUCKET"
 	secretAccessKeyEnvVar = "MINIO_SECRETKEY"
 
-	location = "us-east-1"
-	logname  = "fileup-log"
-	noprefix = ""
+	azureAccountEnvVar = "AZURE_STORAGE_ACCOUNT"
+	azureKeyEnvVar     = "AZURE_STORAGE_KEY"
+
+	b2AccountIDEnvVar = "B2_ACCOUNT_ID"
+	b2AppKeyEnvVar    = "B2_APPLICATION_KEY"
+
+	sseCustomerKeyEnvVar = "SSE_CUSTOMER_KEY"
+
+	logname = "fileup_log"
 )
 
 var (
 	ctx = context.Background()
 
-	filestore      = flag.String("filestore", "", "Endpoint for uploaded files (Required)")
+	filestore      = flag.String("filestore", "", "Endpoint for uploaded files (Required if --backend=minio)")
 	projectid      = flag.String("projectid", "", "Project Id of the project hosting the application (Required)")
 	serviceaccount = flag.String("serviceaccount", "", "Service account to use of publishing (Required)")
 	topic          = flag.String("topic", "", "PubSub topic for notifications (Required)")
-
-	accessKeyId     = cmd.MustGetenv(accessKeyIdEnvVar)
-	bucket          = cmd.MustGetenv(bucketNameEnvVar)
-	secretAccessKey = cmd.MustGetenv(secretAccessKeyEnvVar)
+	busKind        = flag.String("bus", bus.PubSub, "Message bus backend to use (pubsub|mqtt)")
+	mqttBroker     = flag.String("mqttbroker", "", "MQTT broker address host:port (Required if --bus=mqtt)")
+	backend        = flag.String("backend", objectstore.MinIO, "Object store backend for uploaded files (minio|gcs|azure|b2)")
+	storeurl       = flag.String("storeurl", "", "Single-URL form of the upload store (e.g. gs://..., s3://user:pass@host, minio://..., azure://..., b2://...); overrides --backend and its related flags/env vars when set")
+
+	expireDays             = flag.Int("expiredays", 0, "Days after which uploaded objects are deleted, on backends that support bucket lifecycle policies (0 disables)")
+	transitionDays         = flag.Int("transitiondays", 0, "Days after which uploaded objects are transitioned to --transitionstorageclass (0 disables)")
+	transitionStorageClass = flag.String("transitionstorageclass", "", "Storage class objects are transitioned to after --transitiondays")
+	abortMultipartDays     = flag.Int("abortmultipartdays", 0, "Days after which incomplete multipart uploads are aborted (0 disables)")
+	ministsendpoint        = flag.String("ministsendpoint", "", "MinIO STS endpoint to exchange a signed JWT for scoped credentials (bypasses MINIO_ACCESSKEYID/MINIO_SECRETKEY)")
+
+	tokensourcemode    = flag.String("tokensourcemode", "", "OAuth2 token source mode for GCP auth: signjwt (default), adc, jwtfile, or externalaccount")
+	tokensourcekeyfile = flag.String("tokensourcekeyfile", "", "Key file for --tokensourcemode=jwtfile|externalaccount (default GOOGLE_APPLICATION_CREDENTIALS)")
+
+	sseMode     = flag.String("sse-mode", "", "Server-side encryption for directly streamed uploads (none|sse-s3|sse-c|sse-kms, empty disables it)")
+	sseKMSKeyID = flag.String("sse-kms-key-id", "", "KMS key resource name for --sse-mode=sse-kms")
+
+	authKind       = flag.String("auth", "", "HTTP auth backend for upload endpoints (basic|ldap|jwt, empty disables auth)")
+	htpasswdFile   = flag.String("htpasswd", "", "htpasswd file of bcrypt-hashed users (Required if --auth=basic)")
+	ldapAddr       = flag.String("ldapaddr", "", "LDAP server address host:port (Required if --auth=ldap)")
+	ldapBaseDN     = flag.String("ldapbasedn", "", "LDAP search base DN (Required if --auth=ldap)")
+	ldapUserFilter = flag.String("ldapuserfilter", "(uid=%s)", "LDAP search filter template used to resolve a user's DN")
+	ldapUseTLS     = flag.Bool("ldaptls", false, "Use TLS when connecting to the LDAP server")
+	jwtJWKSURL     = flag.String("jwtjwksurl", "", "JWKS URL to verify RS256 JWTs against (Required if --auth=jwt)")
+	jwtIssuer      = flag.String("jwtissuer", "", "Required issuer (iss) claim for JWT auth (empty skips the check)")
+	jwtAudience    = flag.String("jwtaudience", "", "Required audience (aud) claim for JWT auth (empty skips the check)")
+
+	bucket = cmd.MustGetenv(bucketNameEnvVar)
 
 	logger *sdlog.StackdriverLogger
-	mc     *minio.Client
+	store  objectstore.Store
 )
 
-func uploaded(w http.ResponseWriter, r *http.Request) {
-	done := make(chan struct{})
-	defer close(done)
+func newStore(logger *sdlog.StackdriverLogger) (objectstore.Store, error) {
+	if *storeurl != "" {
+		return blob.Open(ctx, *storeurl, logger, satokensource.Mode(*tokensourcemode), *tokensourcekeyfile)
+	}
 
-	result := []FileDesc{}
+	cfg := objectstore.Config{
+		Kind:               *backend,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	}
 
-	objects := mc.ListObjectsV2(bucket, noprefix, true, done)
-	for o := range objects {
-		if o.Err != nil {
-			logger.LogInfo(fmt.Sprintf("Problem listing contents of bucket %s [%+v]", bucket, o.Err))
-			continue
+	switch *backend {
+	case objectstore.GCS:
+	case objectstore.Azure:
+		cfg.AzureAccount = cmd.MustGetenv(azureAccountEnvVar)
+		cfg.AzureKey = cmd.MustGetenv(azureKeyEnvVar)
+	case objectstore.B2:
+		cfg.B2AccountID = cmd.MustGetenv(b2AccountIDEnvVar)
+		cfg.B2ApplicationKey = cmd.MustGetenv(b2AppKeyEnvVar)
+	default:
+		if len(*filestore) == 0 {
+			log.Fatalf("--filestore must be set for the %s backend", objectstore.MinIO)
+		}
+		cfg.Endpoint = *filestore
+
+		if len(*ministsendpoint) > 0 {
+			client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
+			if err != nil {
+				return nil, err
+			}
+
+			cfg.MinIOSTSEndpoint = *ministsendpoint
+			cfg.MinIOSTSSigner = tokensource.NewGCPSigner(client, *projectid, *serviceaccount)
+			cfg.MinIOSTSPolicy = tokensource.ActionPolicy(bucket, "s3:PutObject", "s3:GetObject", "s3:ListBucket")
+		} else {
+			cfg.AccessKeyID = cmd.MustGetenv(accessKeyIdEnvVar)
+			cfg.SecretAccessKey = cmd.MustGetenv(secretAccessKeyEnvVar)
 		}
+	}
+
+	return objectstore.New(ctx, cfg)
+}
 
-		fd := FileDesc{Name: o.Key, Size: o.Size}
-		result = append(result, fd)
+func newAuthenticator() (auth.Authenticator, error) {
+	cfg := auth.Config{
+		Kind:           *authKind,
+		HtpasswdFile:   *htpasswdFile,
+		LDAPAddr:       *ldapAddr,
+		LDAPBaseDN:     *ldapBaseDN,
+		LDAPUserFilter: *ldapUserFilter,
+		LDAPUseTLS:     *ldapUseTLS,
+		JWTJWKSURL:     *jwtJWKSURL,
+		JWTIssuer:      *jwtIssuer,
+		JWTAudience:    *jwtAudience,
 	}
 
-	bs, err := json.Marshal(result)
+	return auth.New(cfg)
+}
+
+// newSSEConfig builds the objectstore.SSEConfig described by --sse-mode, reading the customer
+// key for --sse-mode=sse-c from SSE_CUSTOMER_KEY (base64-encoded, never a flag).
+func newSSEConfig() (objectstore.SSEConfig, error) {
+	cfg := objectstore.SSEConfig{Mode: objectstore.SSEMode(*sseMode), KMSKeyID: *sseKMSKeyID}
+	if cfg.Mode == "none" {
+		cfg.Mode = objectstore.SSENone
+	}
+
+	if cfg.Mode != objectstore.SSEC {
+		return cfg, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(cmd.MustGetenv(sseCustomerKeyEnvVar))
 	if err != nil {
-		logger.LogError(fmt.Sprintf("Could not marshal bucket %s contents list", bucket), err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return objectstore.SSEConfig{}, fmt.Errorf("unable to decode %s: %+v", sseCustomerKeyEnvVar, err)
 	}
+	cfg.CustomerKey = key
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, string(bs))
+	return cfg, nil
 }
 
 func main() {
-	var err error
-
 	flag.Parse()
 
-	if len(*filestore) == 0 || len(*projectid) == 0 || len(*serviceaccount) == 0 || len(*topic) == 0 {
+	if len(*projectid) == 0 || len(*serviceaccount) == 0 || len(*topic) == 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	logger, err := sdlog.Logger(*projectid, logname)
+	var err error
+
+	logger, err = sdlog.Logger(*projectid, logname)
 	if err != nil {
 		log.Fatalf("unable to create Stackdriver logger [%+v]", err)
 	}
 
-	mc, err = minio.New(*filestore, accessKeyId, secretAccessKey, false)
+	store, err = newStore(logger)
 	if err != nil {
 		log.Fatalf("unable to connect to file store: %+v\n", err)
 	}
 
-	exists, err := mc.BucketExists(bucket)
-	if err != nil {
-		log.Fatalf("file store access error: %s [%+v]\n", bucket, err)
+	if lc, ok := store.(objectstore.BucketLifecycle); ok {
+		if err := lc.EnsureBucket(ctx, bucket); err != nil {
+			log.Fatalf("unable to create bucket: %+v\n", err)
+		}
 	}
 
-	if !exists {
-		if err = mc.MakeBucket(bucket, location); err != nil {
-			log.Fatalf("unable to create bucket: %+v\n", err)
+	lifecycle := objectstore.LifecycleConfig{
+		ExpireDays:             *expireDays,
+		TransitionDays:         *transitionDays,
+		TransitionStorageClass: *transitionStorageClass,
+		AbortMultipartDays:     *abortMultipartDays,
+	}
+
+	if lc, ok := store.(objectstore.Lifecycle); ok && lifecycle != (objectstore.LifecycleConfig{}) {
+		if err := lc.SetLifecycle(ctx, bucket, lifecycle); err != nil {
+			log.Fatalf("unable to apply bucket lifecycle policy: %+v\n", err)
 		}
 	}
 
-	http.HandleFunc("/uploaded", uploaded)
-	http.HandleFunc("/_alive", cmd.Liveness)
-	http.HandleFunc("/_ready", cmd.Readiness(mc, bucket))
+	b, err := bus.New(ctx, bus.Config{
+		Kind:               *busKind,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		MQTTBroker:         *mqttBroker,
+		MQTTClientID:       "fileup",
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	})
+	if err != nil {
+		log.Fatalf("message bus creation failed: %+v\n", err)
+	}
 
-	uploader, err := uploader.New(mc, bucket, logger, *projectid, *serviceaccount, *topic)
+	sse, err := newSSEConfig()
+	if err != nil {
+		log.Fatalf("unable to configure server-side encryption: %+v\n", err)
+	}
+
+	ul, err := uploader.New(store, bucket, logger, sse, b, *topic, *projectid, retry.Backoff{})
 	if err != nil {
 		log.Fatalf("uploader creation failed: %+v\n", err)
 	}
-	http.Handle("/upload", uploader)
+
+	authn, err := newAuthenticator()
+	if err != nil {
+		log.Fatalf("unable to configure auth: %+v\n", err)
+	}
+
+	http.Handle("/upload", auth.Middleware(authn, ul))
+	http.Handle("/upload/presign", auth.Middleware(authn, http.HandlerFunc(ul.ServePresign)))
+	http.Handle("/upload/complete", auth.Middleware(authn, http.HandlerFunc(ul.ServeComplete)))
+	http.Handle("/uploaded", auth.Middleware(authn, http.HandlerFunc(ul.ServeUploaded)))
+	http.Handle("/admin/rotate-key", auth.Middleware(authn, http.HandlerFunc(ul.ServeRotateKey)))
+	http.Handle("/_orphans", auth.Middleware(authn, http.HandlerFunc(ul.ServeOrphans)))
+
+	var checks []func() error
+	if lifecycle != (objectstore.LifecycleConfig{}) {
+		checks = append(checks, cmd.LifecycleCheck(ctx, store, bucket, lifecycle))
+	}
+
+	http.HandleFunc("/_alive", cmd.Liveness)
+	http.HandleFunc("/_ready", cmd.Readiness(checks...))
 
 	http.ListenAndServe(":8080", nil)
 }
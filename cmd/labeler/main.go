@@ -9,53 +9,69 @@ import (
 	"os"
 
 	"cloud.google.com/go/pubsub"
-	minio "github.com/minio/minio-go"
+	"github.com/wkharold/fileup/pkg/bus"
 	"github.com/wkharold/fileup/pkg/cmd"
+	"github.com/wkharold/fileup/pkg/crypto"
 	"github.com/wkharold/fileup/pkg/labeler"
+	"github.com/wkharold/fileup/pkg/objectstore"
 	"github.com/wkharold/fileup/pkg/satokensource"
 	"github.com/wkharold/fileup/pkg/sdlog"
-	"golang.org/x/oauth2"
+	"github.com/wkharold/fileup/pkg/tokensource"
 	"golang.org/x/oauth2/google"
 	iam "google.golang.org/api/iam/v1"
-	"google.golang.org/api/option"
 )
 
 const (
+	bucketNameEnvVar = "MINIO_BUCKET"
+
 	accessKeyIdEnvVar     = "MINIO_ACCESSKEYID"
-	bucketNameEnvVar      = "MINIO_BUCKET"
 	secretAccessKeyEnvVar = "MINIO_SECRETKEY"
 
-	location = "us-east-1"
-	logname  = "labeler_log"
-	noprefix = ""
+	azureAccountEnvVar = "AZURE_STORAGE_ACCOUNT"
+	azureKeyEnvVar     = "AZURE_STORAGE_KEY"
+
+	b2AccountIDEnvVar = "B2_ACCOUNT_ID"
+	b2AppKeyEnvVar    = "B2_APPLICATION_KEY"
+
+	logname = "labeler_log"
 )
 
 var (
 	ctx = context.Background()
 
-	filestore      = flag.String("filestore", "", "Endpoint for uploaded files (Required)")
-	imagetopic     = flag.String("imagetopic", "images", "PubSub topic for new image notifications")
-	labeledtopic   = flag.String("labeledtopic", "labeled", "PubSub topic for new label notifications")
-	projectid      = flag.String("projectid", "", "Project Id of the project hosting the application (Required)")
-	serviceaccount = flag.String("serviceaccount", "", "Service account to use of publishing (Required)")
+	filestore       = flag.String("filestore", "", "Endpoint for uploaded files (Required if --backend=minio)")
+	imagetopic      = flag.String("imagetopic", "images", "PubSub topic for new image notifications")
+	labeledtopic    = flag.String("labeledtopic", "labeled", "PubSub topic for new label notifications")
+	projectid       = flag.String("projectid", "", "Project Id of the project hosting the application (Required)")
+	serviceaccount  = flag.String("serviceaccount", "", "Service account to use of publishing (Required)")
+	busKind         = flag.String("bus", bus.PubSub, "Message bus backend to use (pubsub|mqtt)")
+	mqttBroker      = flag.String("mqttbroker", "", "MQTT broker address host:port (Required if --bus=mqtt)")
+	kmskey          = flag.String("kmskey", "", "KMS key resource name to decrypt uploads with (passthrough if empty)")
+	backend         = flag.String("backend", objectstore.MinIO, "Object store backend for uploaded files (minio|gcs|azure|b2)")
+	ministsendpoint = flag.String("ministsendpoint", "", "MinIO STS endpoint to exchange a signed JWT for scoped credentials (bypasses MINIO_ACCESSKEYID/MINIO_SECRETKEY)")
 
-	accessKeyId     = cmd.MustGetenv(accessKeyIdEnvVar)
-	bucket          = cmd.MustGetenv(bucketNameEnvVar)
-	secretAccessKey = cmd.MustGetenv(secretAccessKeyEnvVar)
+	tokensourcemode    = flag.String("tokensourcemode", "", "OAuth2 token source mode for GCP auth: signjwt (default), adc, jwtfile, or externalaccount")
+	tokensourcekeyfile = flag.String("tokensourcekeyfile", "", "Key file for --tokensourcemode=jwtfile|externalaccount (default GOOGLE_APPLICATION_CREDENTIALS)")
+
+	bucket = cmd.MustGetenv(bucketNameEnvVar)
 
 	logger *sdlog.StackdriverLogger
-	mc     *minio.Client
+	store  objectstore.Store
 )
 
 func prestop(w http.ResponseWriter, r *http.Request) {
-	client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
+	ts, err := satokensource.TokenSourceOption(ctx, satokensource.Config{
+		Mode:           satokensource.Mode(*tokensourcemode),
+		Logger:         logger,
+		ProjectID:      *projectid,
+		ServiceAccount: *serviceaccount,
+		KeyFile:        *tokensourcekeyfile,
+	})
 	if err != nil {
-		logger.LogError("Unable to get application default client", err)
+		logger.LogError("Unable to create OAuth2 token source", err)
 		return
 	}
 
-	ts := option.WithTokenSource(oauth2.ReuseTokenSource(nil, satokensource.New(client, logger, *projectid, *serviceaccount)))
-
 	pc, err := pubsub.NewClient(ctx, *projectid, ts)
 	if err != nil {
 		logger.LogError("Unable to create PubSub client", err)
@@ -74,10 +90,52 @@ func prestop(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func newStore(logger *sdlog.StackdriverLogger) (objectstore.Store, error) {
+	cfg := objectstore.Config{
+		Kind:               *backend,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	}
+
+	switch *backend {
+	case objectstore.GCS:
+	case objectstore.Azure:
+		cfg.AzureAccount = cmd.MustGetenv(azureAccountEnvVar)
+		cfg.AzureKey = cmd.MustGetenv(azureKeyEnvVar)
+	case objectstore.B2:
+		cfg.B2AccountID = cmd.MustGetenv(b2AccountIDEnvVar)
+		cfg.B2ApplicationKey = cmd.MustGetenv(b2AppKeyEnvVar)
+	default:
+		if len(*filestore) == 0 {
+			log.Fatalf("--filestore must be set for the %s backend", objectstore.MinIO)
+		}
+		cfg.Endpoint = *filestore
+
+		if len(*ministsendpoint) > 0 {
+			client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
+			if err != nil {
+				return nil, err
+			}
+
+			cfg.MinIOSTSEndpoint = *ministsendpoint
+			cfg.MinIOSTSSigner = tokensource.NewGCPSigner(client, *projectid, *serviceaccount)
+			cfg.MinIOSTSPolicy = tokensource.ActionPolicy(bucket, "s3:GetObject")
+		} else {
+			cfg.AccessKeyID = cmd.MustGetenv(accessKeyIdEnvVar)
+			cfg.SecretAccessKey = cmd.MustGetenv(secretAccessKeyEnvVar)
+		}
+	}
+
+	return objectstore.New(ctx, cfg)
+}
+
 func main() {
 	flag.Parse()
 
-	if len(*filestore) == 0 || len(*projectid) == 0 || len(*serviceaccount) == 0 {
+	if len(*projectid) == 0 || len(*serviceaccount) == 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
@@ -89,12 +147,31 @@ func main() {
 		log.Fatalf("unable to create Stackdriver logger [%+v]", err)
 	}
 
-	mc, err = minio.New(*filestore, accessKeyId, secretAccessKey, false)
+	store, err = newStore(logger)
 	if err != nil {
 		log.Fatalf("unable to connect to file store: %+v\n", err)
 	}
 
-	labeler, err := labeler.New(logger, mc, *projectid, *serviceaccount, *imagetopic, *labeledtopic)
+	b, err := bus.New(ctx, bus.Config{
+		Kind:               *busKind,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		MQTTBroker:         *mqttBroker,
+		MQTTClientID:       "labeler",
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	})
+	if err != nil {
+		log.Fatalf("message bus creation failed: %+v\n", err)
+	}
+
+	enc, err := crypto.New(logger, *projectid, *serviceaccount, *kmskey, satokensource.Mode(*tokensourcemode), *tokensourcekeyfile)
+	if err != nil {
+		log.Fatalf("encryptor creation failed: %+v\n", err)
+	}
+
+	labeler, err := labeler.New(logger, store, enc, *projectid, *serviceaccount, b, *imagetopic, *labeledtopic, satokensource.Mode(*tokensourcemode), *tokensourcekeyfile)
 	if err != nil {
 		log.Fatalf("labeler creation failed [%+v]", err)
 	}
@@ -102,7 +179,7 @@ func main() {
 	go func() {
 		http.HandleFunc("/_alive", cmd.Liveness)
 		http.HandleFunc("/_prestop", prestop)
-		http.HandleFunc("/_ready", cmd.Readiness)
+		http.HandleFunc("/_ready", cmd.Readiness())
 
 		http.ListenAndServe(":8080", nil)
 	}()
@@ -7,43 +7,99 @@ import (
 	"net/http"
 	"os"
 
-	"cloud.google.com/go/logging"
-	minio "github.com/minio/minio-go"
+	"github.com/wkharold/fileup/pkg/bus"
 	"github.com/wkharold/fileup/pkg/cmd"
+	"github.com/wkharold/fileup/pkg/objectstore"
 	"github.com/wkharold/fileup/pkg/purger"
+	"github.com/wkharold/fileup/pkg/satokensource"
 	"github.com/wkharold/fileup/pkg/sdlog"
+	"github.com/wkharold/fileup/pkg/tokensource"
+	"golang.org/x/oauth2/google"
+	iam "google.golang.org/api/iam/v1"
 )
 
 const (
+	bucketNameEnvVar = "MINIO_BUCKET"
+
 	accessKeyIdEnvVar     = "MINIO_ACCESSKEYID"
-	bucketNameEnvVar      = "MINIO_BUCKET"
 	secretAccessKeyEnvVar = "MINIO_SECRETKEY"
 
-	location = "us-east-1"
-	logname  = "purger_log"
-	noprefix = ""
+	azureAccountEnvVar = "AZURE_STORAGE_ACCOUNT"
+	azureKeyEnvVar     = "AZURE_STORAGE_KEY"
+
+	b2AccountIDEnvVar = "B2_ACCOUNT_ID"
+	b2AppKeyEnvVar    = "B2_APPLICATION_KEY"
+
+	logname = "purger_log"
 )
 
 var (
 	ctx = context.Background()
 
-	filestore      = flag.String("filestore", "", "Endpoint for uploaded files (Required)")
-	projectid      = flag.String("projectid", "", "Project Id of the project hosting the application (Required)")
-	purgetopic     = flag.String("purgetopic", "purge", "PubSub topic for purge notifications")
-	serviceaccount = flag.String("serviceaccount", "", "Service account to use of publishing (Required)")
+	filestore       = flag.String("filestore", "", "Endpoint for uploaded files (Required if --backend=minio)")
+	projectid       = flag.String("projectid", "", "Project Id of the project hosting the application (Required)")
+	purgetopic      = flag.String("purgetopic", "purge", "PubSub topic for purge notifications")
+	serviceaccount  = flag.String("serviceaccount", "", "Service account to use of publishing (Required)")
+	busKind         = flag.String("bus", bus.PubSub, "Message bus backend to use (pubsub|mqtt)")
+	mqttBroker      = flag.String("mqttbroker", "", "MQTT broker address host:port (Required if --bus=mqtt)")
+	backend         = flag.String("backend", objectstore.MinIO, "Object store backend for uploaded files (minio|gcs|azure|b2)")
+	ministsendpoint = flag.String("ministsendpoint", "", "MinIO STS endpoint to exchange a signed JWT for scoped credentials (bypasses MINIO_ACCESSKEYID/MINIO_SECRETKEY)")
+
+	tokensourcemode    = flag.String("tokensourcemode", "", "OAuth2 token source mode for GCP auth: signjwt (default), adc, jwtfile, or externalaccount")
+	tokensourcekeyfile = flag.String("tokensourcekeyfile", "", "Key file for --tokensourcemode=jwtfile|externalaccount (default GOOGLE_APPLICATION_CREDENTIALS)")
 
-	accessKeyId     = cmd.MustGetenv(accessKeyIdEnvVar)
-	bucket          = cmd.MustGetenv(bucketNameEnvVar)
-	secretAccessKey = cmd.MustGetenv(secretAccessKeyEnvVar)
+	bucket = cmd.MustGetenv(bucketNameEnvVar)
 
-	logger *logging.Logger
-	mc     *minio.Client
+	logger *sdlog.StackdriverLogger
+	store  objectstore.Store
 )
 
+func newStore(logger *sdlog.StackdriverLogger) (objectstore.Store, error) {
+	cfg := objectstore.Config{
+		Kind:               *backend,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	}
+
+	switch *backend {
+	case objectstore.GCS:
+	case objectstore.Azure:
+		cfg.AzureAccount = cmd.MustGetenv(azureAccountEnvVar)
+		cfg.AzureKey = cmd.MustGetenv(azureKeyEnvVar)
+	case objectstore.B2:
+		cfg.B2AccountID = cmd.MustGetenv(b2AccountIDEnvVar)
+		cfg.B2ApplicationKey = cmd.MustGetenv(b2AppKeyEnvVar)
+	default:
+		if len(*filestore) == 0 {
+			log.Fatalf("--filestore must be set for the %s backend", objectstore.MinIO)
+		}
+		cfg.Endpoint = *filestore
+
+		if len(*ministsendpoint) > 0 {
+			client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
+			if err != nil {
+				return nil, err
+			}
+
+			cfg.MinIOSTSEndpoint = *ministsendpoint
+			cfg.MinIOSTSSigner = tokensource.NewGCPSigner(client, *projectid, *serviceaccount)
+			cfg.MinIOSTSPolicy = tokensource.ActionPolicy(bucket, "s3:DeleteObject", "s3:ListBucket")
+		} else {
+			cfg.AccessKeyID = cmd.MustGetenv(accessKeyIdEnvVar)
+			cfg.SecretAccessKey = cmd.MustGetenv(secretAccessKeyEnvVar)
+		}
+	}
+
+	return objectstore.New(ctx, cfg)
+}
+
 func main() {
 	flag.Parse()
 
-	if len(*filestore) == 0 || len(*projectid) == 0 || len(*serviceaccount) == 0 {
+	if len(*projectid) == 0 || len(*serviceaccount) == 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
@@ -53,19 +109,33 @@ func main() {
 		log.Fatalf("unable to create Stackdriver logger [%+v]", err)
 	}
 
-	mc, err = minio.New(*filestore, accessKeyId, secretAccessKey, false)
+	store, err = newStore(logger)
 	if err != nil {
 		log.Fatalf("unable to connect to file store: %+v\n", err)
 	}
 
-	purger, err := purger.New(logger, mc, *projectid, *serviceaccount, *purgetopic)
+	b, err := bus.New(ctx, bus.Config{
+		Kind:               *busKind,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		MQTTBroker:         *mqttBroker,
+		MQTTClientID:       "purger",
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	})
+	if err != nil {
+		log.Fatalf("message bus creation failed: %+v\n", err)
+	}
+
+	purger, err := purger.New(logger, store, *projectid, b, *purgetopic)
 	if err != nil {
-		log.Fatalf("recognizer creation failed [%+v]", err)
+		log.Fatalf("purger creation failed [%+v]", err)
 	}
 
 	go func() {
 		http.HandleFunc("/_alive", cmd.Liveness)
-		http.HandleFunc("/_ready", cmd.Readiness)
+		http.HandleFunc("/_ready", cmd.Readiness())
 
 		http.ListenAndServe(":8080", nil)
 	}()
@@ -3,24 +3,39 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 
-	minio "github.com/minio/minio-go"
+	"github.com/wkharold/fileup/pkg/bus"
 	"github.com/wkharold/fileup/pkg/cmd"
+	"github.com/wkharold/fileup/pkg/crypto"
+	"github.com/wkharold/fileup/pkg/objectstore"
 	"github.com/wkharold/fileup/pkg/receiver"
+	"github.com/wkharold/fileup/pkg/satokensource"
 	"github.com/wkharold/fileup/pkg/sdlog"
+	"github.com/wkharold/fileup/pkg/tokensource"
+	"golang.org/x/oauth2/google"
+	iam "google.golang.org/api/iam/v1"
 )
 
 const (
+	bucketNameEnvVar = "MINIO_BUCKET"
+
 	accessKeyIDEnvVar     = "MINIO_ACCESSKEYID"
-	bucketNameEnvVar      = "MINIO_BUCKET"
 	secretAccessKeyEnvVar = "MINIO_SECRETKEY"
 
-	location = "us-east-1"
+	azureAccountEnvVar = "AZURE_STORAGE_ACCOUNT"
+	azureKeyEnvVar     = "AZURE_STORAGE_KEY"
+
+	b2AccountIDEnvVar = "B2_ACCOUNT_ID"
+	b2AppKeyEnvVar    = "B2_APPLICATION_KEY"
+
+	sseCustomerKeyEnvVar = "SSE_CUSTOMER_KEY"
+
 	logname  = "receiver_log"
 	noprefix = ""
 )
@@ -28,79 +43,176 @@ const (
 var (
 	ctx = context.Background()
 
-	filestore      = flag.String("filestore", "", "Endpoint for uploaded files (Required)")
+	lifecycle objectstore.LifecycleConfig
+
+	filestore      = flag.String("filestore", "", "Endpoint for uploaded files (Required if --backend=minio)")
 	projectid      = flag.String("projectid", "", "Project ID of the project hosting the application (Required)")
 	serviceaccount = flag.String("serviceaccount", "", "Service account to use of publishing (Required)")
 	topic          = flag.String("topic", "", "PubSub topic for notifications (Required)")
+	busKind        = flag.String("bus", bus.PubSub, "Message bus backend to use (pubsub|mqtt)")
+	mqttBroker     = flag.String("mqttbroker", "", "MQTT broker address host:port (Required if --bus=mqtt)")
+	kmskey         = flag.String("kmskey", "", "KMS key resource name to envelope-encrypt uploads with (passthrough if empty)")
+	backend        = flag.String("backend", objectstore.MinIO, "Object store backend for uploaded files (minio|gcs|azure|b2)")
+
+	expireDays             = flag.Int("expiredays", 0, "Days after which uploaded objects are deleted, on backends that support bucket lifecycle policies (0 disables)")
+	transitionDays         = flag.Int("transitiondays", 0, "Days after which uploaded objects are transitioned to --transitionstorageclass (0 disables)")
+	transitionStorageClass = flag.String("transitionstorageclass", "", "Storage class objects are transitioned to after --transitiondays")
+	abortMultipartDays     = flag.Int("abortmultipartdays", 0, "Days after which incomplete multipart uploads are aborted (0 disables)")
+	ministsendpoint        = flag.String("ministsendpoint", "", "MinIO STS endpoint to exchange a signed JWT for scoped credentials (bypasses MINIO_ACCESSKEYID/MINIO_SECRETKEY)")
+
+	tokensourcemode    = flag.String("tokensourcemode", "", "OAuth2 token source mode for GCP auth: signjwt (default), adc, jwtfile, or externalaccount")
+	tokensourcekeyfile = flag.String("tokensourcekeyfile", "", "Key file for --tokensourcemode=jwtfile|externalaccount (default GOOGLE_APPLICATION_CREDENTIALS)")
 
-	accessKeyID     = cmd.MustGetenv(accessKeyIDEnvVar)
-	bucket          = cmd.MustGetenv(bucketNameEnvVar)
-	secretAccessKey = cmd.MustGetenv(secretAccessKeyEnvVar)
+	sseMode     = flag.String("sse-mode", "", "Server-side encryption for received objects (none|sse-s3|sse-c|sse-kms, empty disables it)")
+	sseKMSKeyID = flag.String("sse-kms-key-id", "", "KMS key resource name for --sse-mode=sse-kms")
+
+	bucket = cmd.MustGetenv(bucketNameEnvVar)
 
 	logger *sdlog.StackdriverLogger
-	mc     *minio.Client
+	store  objectstore.Store
 )
 
 func prestop(w http.ResponseWriter, r *http.Request) {
-	done := make(chan struct{})
-	defer close(done)
+	objs, err := store.List(ctx, bucket, noprefix)
+	if err != nil {
+		logger.LogError(fmt.Sprintf("Problem listing contents of bucket %s", bucket), err)
+		return
+	}
 
-	for obj := range mc.ListObjectsV2(bucket, noprefix, true, done) {
-		if obj.Err != nil {
-			logger.LogError(fmt.Sprintf("Problem listing contents of bucket %s", bucket), obj.Err)
-			continue
-		}
-		mc.RemoveObject(bucket, obj.Key)
+	for _, obj := range objs {
+		store.Remove(ctx, bucket, obj.Key)
 	}
 
-	if err := mc.RemoveBucket(bucket); err != nil {
+	lc, ok := store.(objectstore.BucketLifecycle)
+	if !ok {
+		return
+	}
+
+	if err := lc.RemoveBucket(ctx, bucket); err != nil {
 		logger.LogError(fmt.Sprintf("Unable to remove local storage bucket %s", bucket), err)
 	}
 }
 
 func readiness(w http.ResponseWriter, r *http.Request) {
-	if mc == nil {
+	if store == nil {
 		w.WriteHeader(http.StatusExpectationFailed)
 		return
 	}
 
-	exists, err := mc.BucketExists(bucket)
-	if err != nil || !exists {
+	if _, err := store.List(ctx, bucket, noprefix); err != nil {
 		w.WriteHeader(http.StatusExpectationFailed)
 		return
 	}
 
+	if lifecycle != (objectstore.LifecycleConfig{}) {
+		if err := cmd.LifecycleCheck(ctx, store, bucket, lifecycle)(); err != nil {
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
+func newStore(logger *sdlog.StackdriverLogger) (objectstore.Store, error) {
+	cfg := objectstore.Config{
+		Kind:               *backend,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	}
+
+	switch *backend {
+	case objectstore.GCS:
+	case objectstore.Azure:
+		cfg.AzureAccount = cmd.MustGetenv(azureAccountEnvVar)
+		cfg.AzureKey = cmd.MustGetenv(azureKeyEnvVar)
+	case objectstore.B2:
+		cfg.B2AccountID = cmd.MustGetenv(b2AccountIDEnvVar)
+		cfg.B2ApplicationKey = cmd.MustGetenv(b2AppKeyEnvVar)
+	default:
+		if len(*filestore) == 0 {
+			log.Fatalf("--filestore must be set for the %s backend", objectstore.MinIO)
+		}
+		cfg.Endpoint = *filestore
+
+		if len(*ministsendpoint) > 0 {
+			client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
+			if err != nil {
+				return nil, err
+			}
+
+			cfg.MinIOSTSEndpoint = *ministsendpoint
+			cfg.MinIOSTSSigner = tokensource.NewGCPSigner(client, *projectid, *serviceaccount)
+			cfg.MinIOSTSPolicy = tokensource.ActionPolicy(bucket, "s3:PutObject", "s3:GetObject", "s3:ListBucket", "s3:DeleteObject")
+		} else {
+			cfg.AccessKeyID = cmd.MustGetenv(accessKeyIDEnvVar)
+			cfg.SecretAccessKey = cmd.MustGetenv(secretAccessKeyEnvVar)
+		}
+	}
+
+	return objectstore.New(ctx, cfg)
+}
+
+// newSSEConfig builds the objectstore.SSEConfig described by --sse-mode, reading the
+// customer key for --sse-mode=sse-c from SSE_CUSTOMER_KEY (base64-encoded, never a flag).
+func newSSEConfig() (objectstore.SSEConfig, error) {
+	cfg := objectstore.SSEConfig{Mode: objectstore.SSEMode(*sseMode), KMSKeyID: *sseKMSKeyID}
+	if cfg.Mode == "none" {
+		cfg.Mode = objectstore.SSENone
+	}
+
+	if cfg.Mode != objectstore.SSEC {
+		return cfg, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(cmd.MustGetenv(sseCustomerKeyEnvVar))
+	if err != nil {
+		return objectstore.SSEConfig{}, fmt.Errorf("unable to decode %s: %+v", sseCustomerKeyEnvVar, err)
+	}
+	cfg.CustomerKey = key
+
+	return cfg, nil
+}
+
 func main() {
 	var err error
 
 	flag.Parse()
 
-	if len(*filestore) == 0 || len(*projectid) == 0 || len(*serviceaccount) == 0 || len(*topic) == 0 {
+	if len(*projectid) == 0 || len(*serviceaccount) == 0 || len(*topic) == 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	logger, err := sdlog.Logger(*projectid, logname)
+	logger, err = sdlog.Logger(*projectid, logname)
 	if err != nil {
 		log.Fatalf("unable to create Stackdriver logger [%+v]", err)
 	}
 
-	mc, err = minio.New(*filestore, accessKeyID, secretAccessKey, false)
+	store, err = newStore(logger)
 	if err != nil {
 		log.Fatalf("unable to connect to file store: %+v\n", err)
 	}
 
-	exists, err := mc.BucketExists(bucket)
-	if err != nil {
-		log.Fatalf("file store access error: %s [%+v]\n", bucket, err)
+	if lc, ok := store.(objectstore.BucketLifecycle); ok {
+		if err := lc.EnsureBucket(ctx, bucket); err != nil {
+			log.Fatalf("unable to create bucket: %+v\n", err)
+		}
 	}
 
-	if !exists {
-		if err = mc.MakeBucket(bucket, location); err != nil {
-			log.Fatalf("unable to create bucket: %+v\n", err)
+	lifecycle = objectstore.LifecycleConfig{
+		ExpireDays:             *expireDays,
+		TransitionDays:         *transitionDays,
+		TransitionStorageClass: *transitionStorageClass,
+		AbortMultipartDays:     *abortMultipartDays,
+	}
+
+	if lc, ok := store.(objectstore.Lifecycle); ok && lifecycle != (objectstore.LifecycleConfig{}) {
+		if err := lc.SetLifecycle(ctx, bucket, lifecycle); err != nil {
+			log.Fatalf("unable to apply bucket lifecycle policy: %+v\n", err)
 		}
 	}
 
@@ -108,7 +220,31 @@ func main() {
 	http.HandleFunc("/_alive", cmd.Liveness)
 	http.HandleFunc("/_ready", readiness)
 
-	receiver, err := receiver.New(mc, bucket, logger, *projectid, *serviceaccount, *topic)
+	b, err := bus.New(ctx, bus.Config{
+		Kind:               *busKind,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		MQTTBroker:         *mqttBroker,
+		MQTTClientID:       "receiver",
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	})
+	if err != nil {
+		log.Fatalf("message bus creation failed: %+v\n", err)
+	}
+
+	enc, err := crypto.New(logger, *projectid, *serviceaccount, *kmskey, satokensource.Mode(*tokensourcemode), *tokensourcekeyfile)
+	if err != nil {
+		log.Fatalf("encryptor creation failed: %+v\n", err)
+	}
+
+	sse, err := newSSEConfig()
+	if err != nil {
+		log.Fatalf("unable to configure server-side encryption: %+v\n", err)
+	}
+
+	receiver, err := receiver.New(store, bucket, logger, enc, sse, b, *topic, *projectid)
 	if err != nil {
 		log.Fatalf("receiver creation failed: %+v\n", err)
 	}
@@ -2,22 +2,40 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 
-	"cloud.google.com/go/logging"
-	minio "github.com/minio/minio-go"
-	"github.com/wkharold/fileup/recognizer"
+	"github.com/wkharold/fileup/pkg/blob"
+	"github.com/wkharold/fileup/pkg/bus"
+	"github.com/wkharold/fileup/pkg/cmd"
+	"github.com/wkharold/fileup/pkg/crypto"
+	"github.com/wkharold/fileup/pkg/objectstore"
+	"github.com/wkharold/fileup/pkg/recognizer"
+	"github.com/wkharold/fileup/pkg/satokensource"
+	"github.com/wkharold/fileup/pkg/sdlog"
+	"github.com/wkharold/fileup/pkg/tokensource"
+	"golang.org/x/oauth2/google"
+	iam "google.golang.org/api/iam/v1"
 )
 
 const (
+	bucketNameEnvVar = "MINIO_BUCKET"
+
 	accessKeyIdEnvVar     = "MINIO_ACCESSKEYID"
-	bucketNameEnvVar      = "MINIO_BUCKET"
 	secretAccessKeyEnvVar = "MINIO_SECRETKEY"
 
-	location = "us-east-1"
+	azureAccountEnvVar = "AZURE_STORAGE_ACCOUNT"
+	azureKeyEnvVar     = "AZURE_STORAGE_KEY"
+
+	b2AccountIDEnvVar = "B2_ACCOUNT_ID"
+	b2AppKeyEnvVar    = "B2_APPLICATION_KEY"
+
+	sseCustomerKeyEnvVar = "SSE_CUSTOMER_KEY"
+
 	logname  = "recognizer_log"
 	noprefix = ""
 )
@@ -25,54 +43,152 @@ const (
 var (
 	ctx = context.Background()
 
-	filestore       = flag.String("filestore", "", "Endpoint for uploaded files (Required)")
+	filestore       = flag.String("filestore", "", "Endpoint for uploaded files (Required if --backend=minio)")
 	imagetopic      = flag.String("imagetopic", "image", "PubSub topic for new image notifications")
 	projectid       = flag.String("projectid", "", "Project Id of the project hosting the application (Required)")
-	purgetopic      = flag.String("purgetopic", "purge", "PubSub topic for purge notifications")
-	recognizedtopic = flag.String("recognizedtopic", "", "PubSub topic for image recognition notification (Required)")
+	rulesetfile     = flag.String("rulesetfile", "", "Path to the JSON rule set describing which Vision conditions publish to which topics (Required)")
 	serviceaccount  = flag.String("serviceaccount", "", "Service account to use of publishing (Required)")
-	targetlabel     = flag.String("targetlabel", "cat", "Target label for image recognition")
+	busKind         = flag.String("bus", bus.PubSub, "Message bus backend to use (pubsub|mqtt)")
+	mqttBroker      = flag.String("mqttbroker", "", "MQTT broker address host:port (Required if --bus=mqtt)")
+	kmskey          = flag.String("kmskey", "", "KMS key resource name to decrypt uploads with (passthrough if empty)")
+	backend         = flag.String("backend", objectstore.MinIO, "Object store backend for uploaded files (minio|gcs|azure|b2)")
+	storeurl        = flag.String("storeurl", "", "Single-URL form of the upload store (e.g. gs://..., s3://user:pass@host, minio://..., azure://..., b2://...); overrides --backend and its related flags/env vars when set")
+	ministsendpoint = flag.String("ministsendpoint", "", "MinIO STS endpoint to exchange a signed JWT for scoped credentials (bypasses MINIO_ACCESSKEYID/MINIO_SECRETKEY)")
+
+	tokensourcemode    = flag.String("tokensourcemode", "", "OAuth2 token source mode for GCP auth: signjwt (default), adc, jwtfile, or externalaccount")
+	tokensourcekeyfile = flag.String("tokensourcekeyfile", "", "Key file for --tokensourcemode=jwtfile|externalaccount (default GOOGLE_APPLICATION_CREDENTIALS)")
 
-	accessKeyId     = mustGetenv(accessKeyIdEnvVar)
-	bucket          = mustGetenv(bucketNameEnvVar)
-	secretAccessKey = mustGetenv(secretAccessKeyEnvVar)
+	sseMode     = flag.String("sse-mode", "", "Server-side encryption protecting received objects (none|sse-s3|sse-c|sse-kms, empty disables it)")
+	sseKMSKeyID = flag.String("sse-kms-key-id", "", "KMS key resource name for --sse-mode=sse-kms")
 
-	logger *logging.Logger
-	mc     *minio.Client
+	bucket = cmd.MustGetenv(bucketNameEnvVar)
+
+	logger *sdlog.StackdriverLogger
+	store  objectstore.Store
 )
 
+func newStore(logger *sdlog.StackdriverLogger) (objectstore.Store, error) {
+	if *storeurl != "" {
+		return blob.Open(ctx, *storeurl, logger, satokensource.Mode(*tokensourcemode), *tokensourcekeyfile)
+	}
+
+	cfg := objectstore.Config{
+		Kind:               *backend,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	}
+
+	switch *backend {
+	case objectstore.GCS:
+	case objectstore.Azure:
+		cfg.AzureAccount = cmd.MustGetenv(azureAccountEnvVar)
+		cfg.AzureKey = cmd.MustGetenv(azureKeyEnvVar)
+	case objectstore.B2:
+		cfg.B2AccountID = cmd.MustGetenv(b2AccountIDEnvVar)
+		cfg.B2ApplicationKey = cmd.MustGetenv(b2AppKeyEnvVar)
+	default:
+		if len(*filestore) == 0 {
+			log.Fatalf("--filestore must be set for the %s backend", objectstore.MinIO)
+		}
+		cfg.Endpoint = *filestore
+
+		if len(*ministsendpoint) > 0 {
+			client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
+			if err != nil {
+				return nil, err
+			}
+
+			cfg.MinIOSTSEndpoint = *ministsendpoint
+			cfg.MinIOSTSSigner = tokensource.NewGCPSigner(client, *projectid, *serviceaccount)
+			cfg.MinIOSTSPolicy = tokensource.ActionPolicy(bucket, "s3:GetObject")
+		} else {
+			cfg.AccessKeyID = cmd.MustGetenv(accessKeyIdEnvVar)
+			cfg.SecretAccessKey = cmd.MustGetenv(secretAccessKeyEnvVar)
+		}
+	}
+
+	return objectstore.New(ctx, cfg)
+}
+
+// newSSEConfig builds the objectstore.SSEConfig described by --sse-mode, reading the
+// customer key for --sse-mode=sse-c from SSE_CUSTOMER_KEY (base64-encoded, never a flag). It
+// must match the configuration the receiver used to write the object.
+func newSSEConfig() (objectstore.SSEConfig, error) {
+	cfg := objectstore.SSEConfig{Mode: objectstore.SSEMode(*sseMode), KMSKeyID: *sseKMSKeyID}
+	if cfg.Mode == "none" {
+		cfg.Mode = objectstore.SSENone
+	}
+
+	if cfg.Mode != objectstore.SSEC {
+		return cfg, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(cmd.MustGetenv(sseCustomerKeyEnvVar))
+	if err != nil {
+		return objectstore.SSEConfig{}, fmt.Errorf("unable to decode %s: %+v", sseCustomerKeyEnvVar, err)
+	}
+	cfg.CustomerKey = key
+
+	return cfg, nil
+}
+
 func main() {
 	flag.Parse()
 
-	if len(*filestore) == 0 || len(*projectid) == 0 || len(*recognizedtopic) == 0 || len(*serviceaccount) == 0 {
+	if len(*projectid) == 0 || len(*rulesetfile) == 0 || len(*serviceaccount) == 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	lc, err := logging.NewClient(ctx, *projectid)
+	logger, err := sdlog.Logger(*projectid, logname)
 	if err != nil {
-		log.Fatalf("unable to create logging client: %+v\n", err)
+		log.Fatalf("unable to create Stackdriver logger [%+v]", err)
 	}
-	defer lc.Close()
 
-	lc.OnError = func(e error) {
-		log.Printf("logging client error: %+v", e)
+	store, err = newStore(logger)
+	if err != nil {
+		log.Fatalf("unable to connect to file store: %+v\n", err)
 	}
 
-	logger = lc.Logger(logname)
+	b, err := bus.New(ctx, bus.Config{
+		Kind:               *busKind,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		MQTTBroker:         *mqttBroker,
+		MQTTClientID:       "recognizer",
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	})
+	if err != nil {
+		log.Fatalf("message bus creation failed: %+v\n", err)
+	}
 
-	mc, err = minio.New(*filestore, accessKeyId, secretAccessKey, false)
+	enc, err := crypto.New(logger, *projectid, *serviceaccount, *kmskey, satokensource.Mode(*tokensourcemode), *tokensourcekeyfile)
 	if err != nil {
-		log.Fatalf("unable to connect to file store: %+v\n", err)
+		log.Fatalf("encryptor creation failed: %+v\n", err)
+	}
+
+	sse, err := newSSEConfig()
+	if err != nil {
+		log.Fatalf("unable to configure server-side encryption: %+v\n", err)
 	}
 
-	recognizer, err := recognizer.New(logger, mc, *projectid, *serviceaccount, *imagetopic, *purgetopic, *recognizedtopic, *targetlabel)
+	rules, err := recognizer.LoadRuleSet(*rulesetfile)
+	if err != nil {
+		log.Fatalf("unable to load rule set: %+v\n", err)
+	}
+
+	recognizer, err := recognizer.New(logger, store, enc, sse, *projectid, *serviceaccount, b, *imagetopic, rules, satokensource.Mode(*tokensourcemode), *tokensourcekeyfile)
 	if err != nil {
 		log.Fatalf("recognizer creation failed [%+v]", err)
 	}
 
 	go func() {
-		http.HandleFunc("/_alive", liveness)
+		http.HandleFunc("/_alive", cmd.Liveness)
 		http.HandleFunc("/_ready", readiness)
 
 		http.ListenAndServe(":8080", nil)
@@ -81,26 +197,13 @@ func main() {
 	recognizer.ReceiveAndProcess(ctx)
 }
 
-func liveness(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-}
-
-func mustGetenv(name string) string {
-	val := os.Getenv(name)
-	if len(val) == 0 {
-		log.Fatalf("%s must be set", name)
-	}
-	return val
-}
-
 func readiness(w http.ResponseWriter, r *http.Request) {
-	if mc == nil {
+	if store == nil {
 		w.WriteHeader(http.StatusExpectationFailed)
 		return
 	}
 
-	exists, err := mc.BucketExists(bucket)
-	if err != nil || !exists {
+	if _, err := store.List(ctx, bucket, noprefix); err != nil {
 		w.WriteHeader(http.StatusExpectationFailed)
 		return
 	}
@@ -0,0 +1,220 @@
+// Implements the webdav microservice binary, which exposes the fileup upload bucket as a
+// WebDAV share so non-browser clients (macOS Finder, Windows Explorer, rclone, ...) can read
+// and write it directly.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/wkharold/fileup/pkg/auth"
+	"github.com/wkharold/fileup/pkg/bus"
+	"github.com/wkharold/fileup/pkg/cmd"
+	"github.com/wkharold/fileup/pkg/objectstore"
+	"github.com/wkharold/fileup/pkg/satokensource"
+	"github.com/wkharold/fileup/pkg/sdlog"
+	"github.com/wkharold/fileup/pkg/tokensource"
+	"github.com/wkharold/fileup/pkg/webdavfs"
+	"golang.org/x/net/webdav"
+	"golang.org/x/oauth2/google"
+	iam "google.golang.org/api/iam/v1"
+)
+
+const (
+	bucketNameEnvVar = "MINIO_BUCKET"
+
+	accessKeyIdEnvVar     = "MINIO_ACCESSKEYID"
+	secretAccessKeyEnvVar = "MINIO_SECRETKEY"
+
+	azureAccountEnvVar = "AZURE_STORAGE_ACCOUNT"
+	azureKeyEnvVar     = "AZURE_STORAGE_KEY"
+
+	b2AccountIDEnvVar = "B2_ACCOUNT_ID"
+	b2AppKeyEnvVar    = "B2_APPLICATION_KEY"
+
+	logname = "webdav_log"
+)
+
+var (
+	ctx = context.Background()
+
+	filestore      = flag.String("filestore", "", "Endpoint for uploaded files (Required if --backend=minio)")
+	projectid      = flag.String("projectid", "", "Project Id of the project hosting the application (Required)")
+	serviceaccount = flag.String("serviceaccount", "", "Service account to use of publishing (Required)")
+	topic          = flag.String("topic", "", "PubSub topic for notifications (Required)")
+	busKind        = flag.String("bus", bus.PubSub, "Message bus backend to use (pubsub|mqtt)")
+	mqttBroker     = flag.String("mqttbroker", "", "MQTT broker address host:port (Required if --bus=mqtt)")
+	backend        = flag.String("backend", objectstore.MinIO, "Object store backend for uploaded files (minio|gcs|azure|b2)")
+
+	expireDays             = flag.Int("expiredays", 0, "Days after which uploaded objects are deleted, on backends that support bucket lifecycle policies (0 disables)")
+	transitionDays         = flag.Int("transitiondays", 0, "Days after which uploaded objects are transitioned to --transitionstorageclass (0 disables)")
+	transitionStorageClass = flag.String("transitionstorageclass", "", "Storage class objects are transitioned to after --transitiondays")
+	abortMultipartDays     = flag.Int("abortmultipartdays", 0, "Days after which incomplete multipart uploads are aborted (0 disables)")
+	ministsendpoint        = flag.String("ministsendpoint", "", "MinIO STS endpoint to exchange a signed JWT for scoped credentials (bypasses MINIO_ACCESSKEYID/MINIO_SECRETKEY)")
+
+	tokensourcemode    = flag.String("tokensourcemode", "", "OAuth2 token source mode for GCP auth: signjwt (default), adc, jwtfile, or externalaccount")
+	tokensourcekeyfile = flag.String("tokensourcekeyfile", "", "Key file for --tokensourcemode=jwtfile|externalaccount (default GOOGLE_APPLICATION_CREDENTIALS)")
+
+	authKind       = flag.String("auth", "", "HTTP auth backend for the /dav/ share (basic|ldap|jwt, empty disables auth)")
+	htpasswdFile   = flag.String("htpasswd", "", "htpasswd file of bcrypt-hashed users (Required if --auth=basic)")
+	ldapAddr       = flag.String("ldapaddr", "", "LDAP server address host:port (Required if --auth=ldap)")
+	ldapBaseDN     = flag.String("ldapbasedn", "", "LDAP search base DN (Required if --auth=ldap)")
+	ldapUserFilter = flag.String("ldapuserfilter", "(uid=%s)", "LDAP search filter template used to resolve a user's DN")
+	ldapUseTLS     = flag.Bool("ldaptls", false, "Use TLS when connecting to the LDAP server")
+	jwtJWKSURL     = flag.String("jwtjwksurl", "", "JWKS URL to verify RS256 JWTs against (Required if --auth=jwt)")
+	jwtIssuer      = flag.String("jwtissuer", "", "Required issuer (iss) claim for JWT auth (empty skips the check)")
+	jwtAudience    = flag.String("jwtaudience", "", "Required audience (aud) claim for JWT auth (empty skips the check)")
+
+	bucket = cmd.MustGetenv(bucketNameEnvVar)
+
+	logger *sdlog.StackdriverLogger
+	store  objectstore.Store
+)
+
+func newStore(logger *sdlog.StackdriverLogger) (objectstore.Store, error) {
+	cfg := objectstore.Config{
+		Kind:               *backend,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	}
+
+	switch *backend {
+	case objectstore.GCS:
+	case objectstore.Azure:
+		cfg.AzureAccount = cmd.MustGetenv(azureAccountEnvVar)
+		cfg.AzureKey = cmd.MustGetenv(azureKeyEnvVar)
+	case objectstore.B2:
+		cfg.B2AccountID = cmd.MustGetenv(b2AccountIDEnvVar)
+		cfg.B2ApplicationKey = cmd.MustGetenv(b2AppKeyEnvVar)
+	default:
+		if len(*filestore) == 0 {
+			log.Fatalf("--filestore must be set for the %s backend", objectstore.MinIO)
+		}
+		cfg.Endpoint = *filestore
+
+		if len(*ministsendpoint) > 0 {
+			client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
+			if err != nil {
+				return nil, err
+			}
+
+			cfg.MinIOSTSEndpoint = *ministsendpoint
+			cfg.MinIOSTSSigner = tokensource.NewGCPSigner(client, *projectid, *serviceaccount)
+			cfg.MinIOSTSPolicy = tokensource.ActionPolicy(bucket, "s3:PutObject", "s3:GetObject", "s3:ListBucket", "s3:DeleteObject")
+		} else {
+			cfg.AccessKeyID = cmd.MustGetenv(accessKeyIdEnvVar)
+			cfg.SecretAccessKey = cmd.MustGetenv(secretAccessKeyEnvVar)
+		}
+	}
+
+	return objectstore.New(ctx, cfg)
+}
+
+func newAuthenticator() (auth.Authenticator, error) {
+	cfg := auth.Config{
+		Kind:           *authKind,
+		HtpasswdFile:   *htpasswdFile,
+		LDAPAddr:       *ldapAddr,
+		LDAPBaseDN:     *ldapBaseDN,
+		LDAPUserFilter: *ldapUserFilter,
+		LDAPUseTLS:     *ldapUseTLS,
+		JWTJWKSURL:     *jwtJWKSURL,
+		JWTIssuer:      *jwtIssuer,
+		JWTAudience:    *jwtAudience,
+	}
+
+	return auth.New(cfg)
+}
+
+func main() {
+	flag.Parse()
+
+	if len(*projectid) == 0 || len(*serviceaccount) == 0 || len(*topic) == 0 {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	var err error
+
+	logger, err = sdlog.Logger(*projectid, logname)
+	if err != nil {
+		log.Fatalf("unable to create Stackdriver logger [%+v]", err)
+	}
+
+	store, err = newStore(logger)
+	if err != nil {
+		log.Fatalf("unable to connect to file store: %+v\n", err)
+	}
+
+	if lc, ok := store.(objectstore.BucketLifecycle); ok {
+		if err := lc.EnsureBucket(ctx, bucket); err != nil {
+			log.Fatalf("unable to create bucket: %+v\n", err)
+		}
+	}
+
+	lifecycle := objectstore.LifecycleConfig{
+		ExpireDays:             *expireDays,
+		TransitionDays:         *transitionDays,
+		TransitionStorageClass: *transitionStorageClass,
+		AbortMultipartDays:     *abortMultipartDays,
+	}
+
+	if lc, ok := store.(objectstore.Lifecycle); ok && lifecycle != (objectstore.LifecycleConfig{}) {
+		if err := lc.SetLifecycle(ctx, bucket, lifecycle); err != nil {
+			log.Fatalf("unable to apply bucket lifecycle policy: %+v\n", err)
+		}
+	}
+
+	b, err := bus.New(ctx, bus.Config{
+		Kind:               *busKind,
+		ProjectID:          *projectid,
+		ServiceAccount:     *serviceaccount,
+		Logger:             logger,
+		MQTTBroker:         *mqttBroker,
+		MQTTClientID:       "webdav",
+		TokenSourceMode:    satokensource.Mode(*tokensourcemode),
+		TokenSourceKeyFile: *tokensourcekeyfile,
+	})
+	if err != nil {
+		log.Fatalf("message bus creation failed: %+v\n", err)
+	}
+
+	fs, err := webdavfs.New(store, bucket, logger, b, *topic)
+	if err != nil {
+		log.Fatalf("webdav filesystem creation failed: %+v\n", err)
+	}
+
+	dav := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				logger.LogError(fmt.Sprintf("WebDAV %s %s failed", r.Method, r.URL.Path), err)
+			}
+		},
+	}
+
+	authn, err := newAuthenticator()
+	if err != nil {
+		log.Fatalf("unable to configure auth: %+v\n", err)
+	}
+
+	var checks []func() error
+	if lifecycle != (objectstore.LifecycleConfig{}) {
+		checks = append(checks, cmd.LifecycleCheck(ctx, store, bucket, lifecycle))
+	}
+
+	http.Handle("/dav/", auth.Middleware(authn, dav))
+	http.HandleFunc("/_alive", cmd.Liveness)
+	http.HandleFunc("/_ready", cmd.Readiness(checks...))
+
+	http.ListenAndServe(":8080", nil)
+}
@@ -1,177 +1,210 @@
 // Package archiver provides the constructor and ReceiveAndProcess method for the archiver microservice.
 // The archiver microservice is responsible for copying images whose lables match its target lable to
-// Google Cloud Storage.
+// its archive object store.
 package archiver
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"net/http"
 	"strings"
-	"time"
 
-	"cloud.google.com/go/pubsub"
-	"cloud.google.com/go/storage"
-	minio "github.com/minio/minio-go"
-	"github.com/wkharold/fileup/pkg/satokensource"
+	"github.com/wkharold/fileup/pkg/bus"
+	"github.com/wkharold/fileup/pkg/crypto"
+	"github.com/wkharold/fileup/pkg/events"
+	"github.com/wkharold/fileup/pkg/objectstore"
 	"github.com/wkharold/fileup/pkg/sdlog"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	iam "google.golang.org/api/iam/v1"
-	"google.golang.org/api/option"
 )
 
-// An Archiver compares its label to image labels it receives via pubsub.
-// If there is a match the labeled image is copied to cloud storage.
+// sniffLen is the number of leading bytes writeToCloud peeks at to detect an object's content
+// type, matching the buffer size http.DetectContentType itself looks at.
+const sniffLen = 512
+
+// metaUploader is the object metadata key writeToCloud tags the archive copy with, recording the
+// authenticated identity (see auth.User) that originally uploaded the object. Follows the
+// "X-Amz-Meta-*" convention crypto's metadata keys use.
+const metaUploader = "X-Amz-Meta-Fileup-Uploader"
+
+// An Archiver compares its label to image labels it receives via its message bus topic.
+// If there is a match the labeled image is copied to the archive object store.
 type Archiver struct {
 	bucket string
 	label  string
 	logger *sdlog.StackdriverLogger
-	mc     *minio.Client
-	sc     *storage.Client
-	sub    *pubsub.Subscription
+	store  objectstore.Store
+	enc    *crypto.Encryptor
+	srcSSE objectstore.SSEConfig
+	dst    objectstore.Store
+	dstSSE objectstore.SSEConfig
+	bus    bus.Subscriber
+	lt     string
+	sid    string
+	verify bool
 }
 
 var (
 	ctx = context.Background()
 )
 
-// New creates and initializes an Archiver. The archiver will use the specified serviceAccount
-// to subscribe to the labeledTopic and write to the cloud storage bucket.
-func New(logger *sdlog.StackdriverLogger, mc *minio.Client, projectID, serviceAccount, bucket, labeledTopic, subcription, targetlabel string) (*Archiver, error) {
-	client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
-	if err != nil {
-		return nil, err
-	}
-
-	archiver := &Archiver{
+// New creates and initializes an Archiver. The archiver subscribes to labeledTopic via b (under
+// the durable subscription named subcription), so the pipeline can run against any bus.Bus
+// backend (Google PubSub, MQTT, ...), and writes matching images to dst, the archive object
+// store (which may be backed by any objectstore.Store implementation, independent of store, the
+// source). srcSSE describes the server-side encryption (if any) store's objects were written
+// under; dstSSE describes the server-side encryption writeToCloud applies to dst, re-wrapping the
+// object with a matching key as it's copied across stores. verify turns on writeToCloud's SHA-256
+// re-read-back check (see its doc comment); it costs a second fetch and decrypt of every archived
+// object, so it defaults to off.
+func New(logger *sdlog.StackdriverLogger, store objectstore.Store, enc *crypto.Encryptor, srcSSE objectstore.SSEConfig, dst objectstore.Store, dstSSE objectstore.SSEConfig, b bus.Subscriber, bucket, labeledTopic, subcription, targetlabel string, verify bool) (*Archiver, error) {
+	return &Archiver{
 		bucket: bucket,
 		label:  targetlabel,
 		logger: logger,
-		mc:     mc,
-	}
-
-	ts := option.WithTokenSource(oauth2.ReuseTokenSource(nil, satokensource.New(client, logger, projectID, serviceAccount)))
-
-	archiver.sc, err = storage.NewClient(ctx, ts)
-	if err != nil {
-		return nil, err
-	}
-
-	pc, err := pubsub.NewClient(ctx, projectID, ts)
-	if err != nil {
-		return nil, err
-	}
-
-	if archiver.sub, err = subscribe(pc, subcription, labeledTopic); err != nil {
-		return nil, err
-	}
-
-	return archiver, nil
+		store:  store,
+		enc:    enc,
+		srcSSE: srcSSE,
+		dst:    dst,
+		dstSSE: dstSSE,
+		bus:    b,
+		lt:     labeledTopic,
+		sid:    subcription,
+		verify: verify,
+	}, nil
 }
 
-// ReceiveAndProcess responds to messages from the labeledTopic by comparing the
-// archiver's target label to each of the labels in the message. If there is a match
-// the associated image is copied to the archiver's cloud storage bucket.
+// ReceiveAndProcess responds to image.labeled events by comparing the archiver's target label
+// to each of the event's labels. If there is a match the associated image is copied to the
+// archiver's cloud storage bucket.
 func (a Archiver) ReceiveAndProcess(ctx context.Context) {
-	err := a.sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
-		log.Printf("message data: %+v", string(m.Data))
+	err := a.bus.Subscribe(ctx, a.lt, a.sid, func(ctx context.Context, m bus.Message) {
 		defer m.Ack()
 
-		bucket, object, labels, err := parseMessage(m.Data)
+		ev, err := events.Parse(m)
 		if err != nil {
 			a.logger.LogError("Bad message", err)
 			return
 		}
 
-		for _, label := range labels {
+		trace, spanID := events.Trace(ev)
+		logger := a.logger.WithTrace(trace, spanID)
+		events.Log(logger, ev)
+
+		var img events.LabeledImageData
+		if err := events.DataAs(ev, &img); err != nil {
+			logger.LogError(fmt.Sprintf("Unable to decode event %s", ev.ID()), err)
+			return
+		}
+		logger = logger.WithFields(map[string]interface{}{"bucket": img.Bucket, "object": img.Object})
+
+		for _, label := range img.Labels {
 			if strings.Contains(label, a.label) {
-				if err := writeToCloud(a.mc, a.sc, a.logger, a.bucket, bucket, object); err != nil {
-					a.logger.LogError("Cloud write failed", err)
+				if err := writeToCloud(a.store, a.enc, a.srcSSE, a.dst, a.dstSSE, a.bucket, img.Bucket, img.Object, img.Uploader, a.verify); err != nil {
+					logger.LogError("Cloud write failed", err)
 				}
 				return
 			}
 		}
 	})
 	if err != context.Canceled {
-		a.logger.LogError(fmt.Sprintf("Unable to receive from %s", a.sub.ID()), err)
+		a.logger.LogError(fmt.Sprintf("Unable to receive from %s", a.sid), err)
 	}
 }
 
-func parseMessage(msg []byte) (string, string, []string, error) {
-	var df interface{}
-	err := json.Unmarshal(msg, &df)
+// writeToCloud copies lb/o from store to dst as cb/o, decrypting it with enc/srcSSE on the way
+// out and re-encrypting it under dstSSE on the way in, so the archive copy carries its own
+// server-side encryption independent of the source bucket's. The object is streamed straight
+// from store to dst rather than buffered in memory, and its content type is sniffed from its
+// first bytes rather than assumed. writeToCloud always compares the archived copy's size against
+// the source's; if verify is also set it additionally reads the archived copy back through
+// hashObject and compares its SHA-256 against a running hash computed while streaming, catching
+// corruption the size comparison alone would miss. That extra check costs a second fetch and
+// decrypt of the full object (doubling network egress and, under SSE-KMS, a second KMS Decrypt
+// call) per archived file, so it's opt-in rather than automatic; callers that need the stronger
+// guarantee for every archive (e.g. a compliance archive bucket) should turn it on, and anyone
+// who only suspects corruption can reverify after the fact with hashObject directly instead of
+// paying the cost on every write. uploader, the authenticated identity that uploaded the source
+// object (see auth.User), is stamped on the archive copy as metaUploader metadata, if non-empty.
+func writeToCloud(store objectstore.Store, enc *crypto.Encryptor, srcSSE objectstore.SSEConfig, dst objectstore.Store, dstSSE objectstore.SSEConfig, cb, lb, o, uploader string, verify bool) error {
+	info, err := store.Stat(ctx, lb, o)
 	if err != nil {
-		return "", "", []string{}, err
+		return fmt.Errorf("unable to stat %s/%s: %+v", lb, o, err)
 	}
 
-	location := df.(map[string]interface{})["location"]
-	if location == nil || len(location.(string)) == 0 {
-		return "", "", []string{}, fmt.Errorf("empty location field")
+	obj, err := enc.GetObjectSSE(store, srcSSE, lb, o)
+	if err != nil {
+		return err
 	}
 
-	labels := df.(map[string]interface{})["labels"]
-	if labels == nil || len(labels.([]interface{})) == 0 {
-		return "", "", []string{}, fmt.Errorf("empty labels field")
+	br := bufio.NewReader(obj)
+	sniff, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("unable to sniff content type for %s/%s: %+v", lb, o, err)
 	}
+	contentType := http.DetectContentType(sniff)
 
-	locparts := strings.Split(location.(string), "/")
-	if len(locparts) != 2 {
-		return "", "", []string{}, fmt.Errorf("location must have format <bucket>/<object> [%s]", location.(string))
-	}
+	srcHash := sha256.New()
+	tr := io.TeeReader(br, srcHash)
 
-	ls := []string{}
-	for _, l := range labels.([]interface{}) {
-		ls = append(ls, l.(string))
+	var metadata map[string]string
+	if uploader != "" {
+		metadata = map[string]string{metaUploader: uploader}
 	}
 
-	return locparts[0], locparts[1], ls, nil
-}
-
-func subscribe(pc *pubsub.Client, subcription, topic string) (*pubsub.Subscription, error) {
-	sub := pc.Subscription(subcription)
+	if dstSSE.Mode == objectstore.SSENone {
+		err = dst.Put(ctx, cb, o, tr, contentType, metadata)
+	} else {
+		sse, ok := dst.(objectstore.ServerSideEncryption)
+		if !ok {
+			return fmt.Errorf("archive object store does not support server-side encryption")
+		}
 
-	ok, err := sub.Exists(ctx)
+		err = sse.PutEncrypted(ctx, cb, o, tr, contentType, metadata, dstSSE)
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if !ok {
-		sub, err = pc.CreateSubscription(ctx, subcription, pubsub.SubscriptionConfig{
-			Topic:       pc.Topic(topic),
-			AckDeadline: 60 * time.Second,
-		})
-		if err != nil {
-			return nil, err
-		}
+	archived, err := dst.Stat(ctx, cb, o)
+	if err != nil {
+		return fmt.Errorf("unable to stat archived copy %s/%s: %+v", cb, o, err)
 	}
 
-	return sub, nil
-}
+	if archived.Size != info.Size {
+		return fmt.Errorf("archived copy %s/%s is %d bytes, source %s/%s was %d bytes", cb, o, archived.Size, lb, o, info.Size)
+	}
 
-func writeToCloud(mc *minio.Client, sc *storage.Client, logger *sdlog.StackdriverLogger, cb, lb, o string) error {
-	wc := sc.Bucket(cb).Object(o).NewWriter(ctx)
-	wc.ContentType = "application/octet-stream"
+	if !verify {
+		return nil
+	}
 
-	obj, err := mc.GetObject(lb, o)
+	archivedHash, err := hashObject(enc, dst, dstSSE, cb, o)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to verify archived copy %s/%s: %+v", cb, o, err)
 	}
 
-	bs, err := ioutil.ReadAll(obj)
-	if err != nil {
-		return err
+	if !bytes.Equal(archivedHash, srcHash.Sum(nil)) {
+		return fmt.Errorf("archived copy %s/%s failed its SHA-256 integrity check against source %s/%s", cb, o, lb, o)
 	}
 
-	if _, err := wc.Write(bs); err != nil {
-		return err
+	return nil
+}
+
+// hashObject reads bucket/key back through enc/sse and returns its SHA-256 digest, streaming
+// the object through the hash rather than buffering it.
+func hashObject(enc *crypto.Encryptor, store objectstore.Store, sse objectstore.SSEConfig, bucket, key string) ([]byte, error) {
+	obj, err := enc.GetObjectSSE(store, sse, bucket, key)
+	if err != nil {
+		return nil, err
 	}
 
-	if err = wc.Close(); err != nil {
-		return err
+	h := sha256.New()
+	if _, err := io.Copy(h, obj); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return h.Sum(nil), nil
 }
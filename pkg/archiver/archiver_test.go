@@ -0,0 +1,145 @@
+package archiver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/wkharold/fileup/pkg/blob"
+	"github.com/wkharold/fileup/pkg/crypto"
+	"github.com/wkharold/fileup/pkg/objectstore"
+)
+
+// sizedReader generates a deterministic stream of n bytes without ever holding more than one
+// chunk of it in memory, so a test can populate a multi-hundred-MB fake object without actually
+// allocating a multi-hundred-MB buffer itself.
+type sizedReader struct {
+	remaining int64
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	n := len(p)
+	if int64(n) > r.remaining {
+		n = int(r.remaining)
+	}
+	for i := range p[:n] {
+		p[i] = byte(i)
+	}
+	r.remaining -= int64(n)
+
+	return n, nil
+}
+
+func TestWriteToCloudCopiesAndVerifiesAnObject(t *testing.T) {
+	store := blob.NewMemStore()
+	dst := blob.NewMemStore()
+	enc := &crypto.Encryptor{}
+
+	body := []byte("a real image would go here, but any bytes prove the round trip")
+	if err := store.Put(ctx, "incoming", "cat.png", bytes.NewReader(body), "application/octet-stream", nil); err != nil {
+		t.Fatalf("Put() returned an error: %+v", err)
+	}
+
+	if err := writeToCloud(store, enc, objectstore.SSEConfig{}, dst, objectstore.SSEConfig{}, "archive", "incoming", "cat.png", "alice", true); err != nil {
+		t.Fatalf("writeToCloud() returned an error: %+v", err)
+	}
+
+	r, err := dst.Get(ctx, "archive", "cat.png")
+	if err != nil {
+		t.Fatalf("Get() on the archived copy returned an error: %+v", err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unable to read the archived copy: %+v", err)
+	}
+
+	if !bytes.Equal(got, body) {
+		t.Fatalf("archived copy = %q, want %q", got, body)
+	}
+}
+
+// corruptingStore wraps a Store whose Put silently writes different bytes than it was given,
+// simulating in-flight corruption that changes content without changing size.
+type corruptingStore struct {
+	objectstore.Store
+}
+
+func (c corruptingStore) Put(ctx context.Context, bucket, key string, r io.Reader, contentType string, metadata map[string]string) error {
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	corrupted := bytes.Repeat([]byte{'x'}, len(bs))
+
+	return c.Store.Put(ctx, bucket, key, bytes.NewReader(corrupted), contentType, metadata)
+}
+
+func TestWriteToCloudFailsTheIntegrityCheckOnCorruption(t *testing.T) {
+	store := blob.NewMemStore()
+	dst := corruptingStore{blob.NewMemStore()}
+	enc := &crypto.Encryptor{}
+
+	if err := store.Put(ctx, "incoming", "cat.png", bytes.NewReader([]byte("original bytes")), "application/octet-stream", nil); err != nil {
+		t.Fatalf("Put() returned an error: %+v", err)
+	}
+
+	err := writeToCloud(store, enc, objectstore.SSEConfig{}, dst, objectstore.SSEConfig{}, "archive", "incoming", "cat.png", "alice", true)
+	if err == nil {
+		t.Fatal("expected writeToCloud to reject a same-size but corrupted archive copy, got nil")
+	}
+}
+
+func TestWriteToCloudSkipsTheIntegrityCheckWhenVerifyIsFalse(t *testing.T) {
+	store := blob.NewMemStore()
+	dst := corruptingStore{blob.NewMemStore()}
+	enc := &crypto.Encryptor{}
+
+	if err := store.Put(ctx, "incoming", "cat.png", bytes.NewReader([]byte("original bytes")), "application/octet-stream", nil); err != nil {
+		t.Fatalf("Put() returned an error: %+v", err)
+	}
+
+	if err := writeToCloud(store, enc, objectstore.SSEConfig{}, dst, objectstore.SSEConfig{}, "archive", "incoming", "cat.png", "alice", false); err != nil {
+		t.Fatalf("writeToCloud() with verify=false returned an error: %+v", err)
+	}
+}
+
+func TestWriteToCloudStreamsLargeObjectsWithBoundedMemory(t *testing.T) {
+	const size = 256 << 20 // 256 MiB
+
+	store := blob.NewMemStore()
+	dst := blob.NewMemStore()
+	enc := &crypto.Encryptor{}
+
+	if err := store.Put(ctx, "incoming", "big.bin", &sizedReader{remaining: size}, "application/octet-stream", nil); err != nil {
+		t.Fatalf("Put() returned an error: %+v", err)
+	}
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	if err := writeToCloud(store, enc, objectstore.SSEConfig{}, dst, objectstore.SSEConfig{}, "archive", "incoming", "big.bin", "", true); err != nil {
+		t.Fatalf("writeToCloud() returned an error: %+v", err)
+	}
+
+	runtime.GC()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+
+	// dst (a MemStore) necessarily holds one copy of the archived object, so heap growth of
+	// roughly `size` is expected; growth well beyond that would mean writeToCloud buffered the
+	// object an extra time or more along the way instead of streaming it straight through.
+	threshold := uint64(size + size/2)
+	if grew := after.HeapAlloc - before.HeapAlloc; grew > threshold {
+		t.Fatalf("writeToCloud appears to buffer the object beyond the one copy dst must hold: heap grew by %d bytes copying a %d byte object", grew, int64(size))
+	}
+}
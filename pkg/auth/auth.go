@@ -0,0 +1,47 @@
+// Package auth provides pluggable HTTP authentication for the fileup upload endpoints, so a
+// deployment can require HTTP Basic, LDAP-bound, or bearer-JWT credentials without the
+// uploader/webdav binaries needing to know which.
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey string
+
+const userContextKey contextKey = "auth.user"
+
+// An Authenticator validates the credentials carried by an inbound HTTP request and reports
+// the authenticated username.
+type Authenticator interface {
+	Authenticate(r *http.Request) (user string, ok bool)
+}
+
+// Middleware wraps next so that every request is validated by a before reaching it. Requests
+// that fail authentication get a 401 and never reach next; requests that succeed have their
+// authenticated username attached to the request context, retrievable with User. A nil a
+// (authentication disabled) makes Middleware a no-op wrapper.
+func Middleware(a Authenticator, next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := a.Authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fileup"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	})
+}
+
+// User returns the username Middleware authenticated the request's caller as, and whether one
+// is present.
+func User(r *http.Request) (string, bool) {
+	user, ok := r.Context().Value(userContextKey).(string)
+	return user, ok
+}
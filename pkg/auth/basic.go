@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuthenticator validates HTTP Basic credentials against a htpasswd-format file of
+// bcrypt-hashed entries (as produced by `htpasswd -B`).
+type BasicAuthenticator struct {
+	mu    sync.RWMutex
+	users map[string][]byte // username -> bcrypt hash
+}
+
+// NewBasic loads path as a htpasswd file and returns a BasicAuthenticator backed by its
+// entries. The file is read once at startup; restart the process to pick up changes.
+func NewBasic(path string) (*BasicAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open htpasswd file %s: %+v", path, err)
+	}
+	defer f.Close()
+
+	users := map[string][]byte{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed htpasswd entry %q in %s", line, path)
+		}
+
+		users[parts[0]] = []byte(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read htpasswd file %s: %+v", path, err)
+	}
+
+	return &BasicAuthenticator{users: users}, nil
+}
+
+// Authenticate satisfies auth.Authenticator.
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	a.mu.RLock()
+	hash, known := a.users[user]
+	a.mu.RUnlock()
+	if !known {
+		return "", false
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil {
+		return "", false
+	}
+
+	return user, true
+}
@@ -0,0 +1,52 @@
+package auth
+
+import "fmt"
+
+// Backend names accepted by the --auth flag of the fileup and webdav binaries. The receiver
+// binary has no --auth flag and serves its upload endpoint without authentication.
+const (
+	Basic = "basic"
+	LDAP  = "ldap"
+	JWT   = "jwt"
+)
+
+// Config selects and parameterizes the Authenticator a microservice binary installs in front
+// of its upload endpoints. Only the fields relevant to Kind need be set.
+type Config struct {
+	// Kind is one of Basic, LDAP, or JWT. An empty Kind disables authentication.
+	Kind string
+
+	// HtpasswdFile configures the Basic backend: a htpasswd-format file of bcrypt-hashed
+	// user:password entries (as produced by `htpasswd -B`).
+	HtpasswdFile string
+
+	// LDAPAddr, LDAPBaseDN, LDAPUserFilter, and LDAPUseTLS configure the LDAP backend.
+	LDAPAddr       string
+	LDAPBaseDN     string
+	LDAPUserFilter string
+	LDAPUseTLS     bool
+
+	// JWTJWKSURL, JWTIssuer, and JWTAudience configure the JWT backend: tokens are verified by
+	// RS256 against the RSA public keys published at JWTJWKSURL. JWTIssuer and JWTAudience are
+	// optional; when set they must match the token's iss/aud claims.
+	JWTJWKSURL  string
+	JWTIssuer   string
+	JWTAudience string
+}
+
+// New constructs the Authenticator selected by cfg.Kind. An empty Kind returns a nil
+// Authenticator and a nil error; Middleware treats a nil Authenticator as "no auth required".
+func New(cfg Config) (Authenticator, error) {
+	switch cfg.Kind {
+	case "":
+		return nil, nil
+	case Basic:
+		return NewBasic(cfg.HtpasswdFile)
+	case LDAP:
+		return NewLDAP(cfg.LDAPAddr, cfg.LDAPBaseDN, cfg.LDAPUserFilter, cfg.LDAPUseTLS)
+	case JWT:
+		return NewJWT(cfg.JWTJWKSURL, cfg.JWTIssuer, cfg.JWTAudience)
+	default:
+		return nil, fmt.Errorf("unknown auth backend %q (want %q, %q, or %q)", cfg.Kind, Basic, LDAP, JWT)
+	}
+}
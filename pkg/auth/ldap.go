@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"gopkg.in/ldap.v3"
+)
+
+// LDAPAuthenticator validates HTTP Basic credentials by resolving the user's DN with a search
+// and then binding to the directory as that DN with the supplied password.
+type LDAPAuthenticator struct {
+	addr       string
+	baseDN     string
+	userFilter string
+	useTLS     bool
+}
+
+// NewLDAP creates an LDAPAuthenticator that binds to the directory at addr (host:port),
+// searching baseDN with userFilter (a filter template containing one %s for the escaped
+// username, e.g. "(uid=%s)") to resolve the bind DN. Connections use TLS when useTLS is set.
+func NewLDAP(addr, baseDN, userFilter string, useTLS bool) (*LDAPAuthenticator, error) {
+	if addr == "" || baseDN == "" || userFilter == "" {
+		return nil, fmt.Errorf("ldap auth requires an address, base DN, and user filter")
+	}
+
+	return &LDAPAuthenticator{addr: addr, baseDN: baseDN, userFilter: userFilter, useTLS: useTLS}, nil
+}
+
+// Authenticate satisfies auth.Authenticator. It opens a fresh connection per request and binds
+// as the resolved user DN with the supplied password; directories expected to see heavy
+// traffic should sit behind a connection-pooling LDAP proxy.
+func (a *LDAPAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok || pass == "" {
+		return "", false
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return "", false
+	}
+	defer conn.Close()
+
+	dn, ok := a.resolveDN(conn, user)
+	if !ok {
+		return "", false
+	}
+
+	if err := conn.Bind(dn, pass); err != nil {
+		return "", false
+	}
+
+	return user, true
+}
+
+func (a *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	if a.useTLS {
+		return ldap.DialTLS("tcp", a.addr, nil)
+	}
+
+	return ldap.Dial("tcp", a.addr)
+}
+
+func (a *LDAPAuthenticator) resolveDN(conn *ldap.Conn, user string) (string, bool) {
+	req := ldap.NewSearchRequest(
+		a.baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(a.userFilter, ldap.EscapeFilter(user)),
+		[]string{"dn"},
+		nil,
+	)
+
+	res, err := conn.Search(req)
+	if err != nil || len(res.Entries) != 1 {
+		return "", false
+	}
+
+	return res.Entries[0].DN, true
+}
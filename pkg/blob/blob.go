@@ -0,0 +1,72 @@
+// Package blob provides a URL-based constructor for objectstore.Store backends and an
+// in-memory MemStore implementation, so that Uploader, Archiver, and Recognizer can be
+// constructed and unit-tested without a real MinIO/GCS/Azure/B2 endpoint. It builds on top of
+// objectstore's existing Config.Kind abstraction (see objectstore.New) rather than duplicating
+// it: Open just translates a URL into the equivalent Config.
+package blob
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/wkharold/fileup/pkg/objectstore"
+	"github.com/wkharold/fileup/pkg/satokensource"
+	"github.com/wkharold/fileup/pkg/sdlog"
+)
+
+// Open parses rawurl and returns the objectstore.Store it names, via the same construction path
+// (objectstore.New) the cmd/* binaries use. Supported schemes and the host/userinfo fields they
+// read:
+//
+//	gs://<project-id>?serviceAccount=<account>        Google Cloud Storage
+//	s3://<accesskeyid>:<secretkey>@<endpoint>          MinIO/S3 over TLS
+//	minio://<accesskeyid>:<secretkey>@<endpoint>       MinIO/S3 without TLS
+//	azure://<account>:<key>@                           Azure Blob Storage
+//	b2://<accountid>:<appkey>@                          Backblaze B2
+//
+// tsMode/tsKeyFile and logger are forwarded to objectstore.Config for the gs scheme, which is
+// the only one that needs them.
+func Open(ctx context.Context, rawurl string, logger *sdlog.StackdriverLogger, tsMode satokensource.Mode, tsKeyFile string) (objectstore.Store, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("blob: invalid store URL %q: %+v", rawurl, err)
+	}
+
+	cfg := objectstore.Config{
+		Logger:             logger,
+		TokenSourceMode:    tsMode,
+		TokenSourceKeyFile: tsKeyFile,
+	}
+
+	switch u.Scheme {
+	case "gs":
+		cfg.Kind = objectstore.GCS
+		cfg.ProjectID = u.Host
+		cfg.ServiceAccount = u.Query().Get("serviceAccount")
+	case "s3", "minio":
+		cfg.Kind = objectstore.MinIO
+		cfg.Endpoint = u.Host
+		cfg.UseSSL = u.Scheme == "s3"
+		if u.User != nil {
+			cfg.AccessKeyID = u.User.Username()
+			cfg.SecretAccessKey, _ = u.User.Password()
+		}
+	case "azure":
+		cfg.Kind = objectstore.Azure
+		cfg.AzureAccount = u.Host
+		if u.User != nil {
+			cfg.AzureKey, _ = u.User.Password()
+		}
+	case "b2":
+		cfg.Kind = objectstore.B2
+		cfg.B2AccountID = u.Host
+		if u.User != nil {
+			cfg.B2ApplicationKey, _ = u.User.Password()
+		}
+	default:
+		return nil, fmt.Errorf("blob: unrecognized store URL scheme %q (want gs, s3, minio, azure, or b2)", u.Scheme)
+	}
+
+	return objectstore.New(ctx, cfg)
+}
@@ -0,0 +1,132 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wkharold/fileup/pkg/objectstore"
+)
+
+// memObject is the bytes and metadata MemStore holds for a single bucket/key.
+type memObject struct {
+	data        []byte
+	contentType string
+	metadata    map[string]string
+	modified    time.Time
+}
+
+// MemStore is an in-memory objectstore.Store, for unit-testing Uploader, Archiver, and
+// Recognizer without a real MinIO/GCS/Azure/B2 endpoint. It has no size limit and nothing about
+// it is persisted; it exists purely as a test double.
+type MemStore struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]memObject
+}
+
+// NewMemStore creates an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{buckets: map[string]map[string]memObject{}}
+}
+
+func (m *MemStore) Put(ctx context.Context, bucket, key string, r io.Reader, contentType string, metadata map[string]string) error {
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.buckets[bucket] == nil {
+		m.buckets[bucket] = map[string]memObject{}
+	}
+
+	m.buckets[bucket][key] = memObject{data: bs, contentType: contentType, metadata: metadata, modified: time.Now()}
+
+	return nil
+}
+
+func (m *MemStore) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.buckets[bucket][key]
+	if !ok {
+		return nil, fmt.Errorf("blob: %s/%s not found", bucket, key)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (m *MemStore) Stat(ctx context.Context, bucket, key string) (objectstore.ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.buckets[bucket][key]
+	if !ok {
+		return objectstore.ObjectInfo{}, fmt.Errorf("blob: %s/%s not found", bucket, key)
+	}
+
+	return objectstore.ObjectInfo{
+		Key:          key,
+		Size:         int64(len(obj.data)),
+		LastModified: obj.modified,
+		ContentType:  obj.contentType,
+		Metadata:     obj.metadata,
+	}, nil
+}
+
+func (m *MemStore) List(ctx context.Context, bucket, prefix string) ([]objectstore.ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	infos := []objectstore.ObjectInfo{}
+	for key, obj := range m.buckets[bucket] {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		infos = append(infos, objectstore.ObjectInfo{
+			Key:          key,
+			Size:         int64(len(obj.data)),
+			LastModified: obj.modified,
+			ContentType:  obj.contentType,
+			Metadata:     obj.metadata,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	return infos, nil
+}
+
+func (m *MemStore) Remove(ctx context.Context, bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.buckets[bucket], key)
+
+	return nil
+}
+
+func (m *MemStore) Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string) error {
+	m.mu.Lock()
+	obj, ok := m.buckets[srcBucket][srcKey]
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("blob: %s/%s not found", srcBucket, srcKey)
+	}
+
+	return m.Put(ctx, dstBucket, dstKey, bytes.NewReader(obj.data), obj.contentType, obj.metadata)
+}
+
+func (m *MemStore) Presign(ctx context.Context, bucket, key string, method objectstore.PresignMethod, expiry time.Duration) (string, error) {
+	return fmt.Sprintf("mem://%s/%s?method=%s&expires=%s", bucket, key, method, expiry), nil
+}
@@ -0,0 +1,35 @@
+// Package bus abstracts the message transport used between the fileup
+// microservices so that the pipeline can run on Google PubSub, an MQTT
+// broker, or any other backend that satisfies the Publisher/Subscriber
+// interfaces.
+package bus
+
+import "context"
+
+// A Message is a single unit of data received from a Subscriber. Handlers
+// must call exactly one of Ack or Nack before returning.
+type Message interface {
+	Data() []byte
+	Attributes() map[string]string
+	Ack()
+	Nack()
+}
+
+// A Publisher sends data, with accompanying attributes, to the named topic.
+// It blocks until the publish is acknowledged by the backend.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, data []byte, attrs map[string]string) error
+}
+
+// A Subscriber delivers messages published to topic to handler, using subID
+// to identify the durable subscription/session. Subscribe blocks until ctx
+// is done or the backend reports an unrecoverable error.
+type Subscriber interface {
+	Subscribe(ctx context.Context, topic, subID string, handler func(context.Context, Message)) error
+}
+
+// A Bus is a message transport capable of both publishing and subscribing.
+type Bus interface {
+	Publisher
+	Subscriber
+}
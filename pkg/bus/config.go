@@ -0,0 +1,60 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/wkharold/fileup/pkg/satokensource"
+	"github.com/wkharold/fileup/pkg/sdlog"
+)
+
+// Backend names accepted by the --bus flag on every cmd/* binary.
+const (
+	PubSub = "pubsub"
+	MQTT   = "mqtt"
+)
+
+// Config selects and parameterizes the Bus backend a microservice binary
+// connects to.
+type Config struct {
+	// Kind is one of PubSub or MQTT.
+	Kind string
+
+	// ProjectID and ServiceAccount authenticate the PubSub backend.
+	ProjectID      string
+	ServiceAccount string
+	Logger         *sdlog.StackdriverLogger
+
+	// TokenSourceMode and TokenSourceKeyFile select how the PubSub backend mints OAuth2 tokens;
+	// see satokensource.Config. An empty TokenSourceMode preserves the historical behavior of
+	// impersonating ServiceAccount via the IAM Credentials API.
+	TokenSourceMode    satokensource.Mode
+	TokenSourceKeyFile string
+
+	// MQTTBroker (host:port) and MQTTClientID configure the MQTT backend.
+	MQTTBroker   string
+	MQTTClientID string
+}
+
+// New constructs the Bus selected by cfg.Kind.
+func New(ctx context.Context, cfg Config) (Bus, error) {
+	switch cfg.Kind {
+	case "", PubSub:
+		ts, err := satokensource.TokenSourceOption(ctx, satokensource.Config{
+			Mode:           cfg.TokenSourceMode,
+			Logger:         cfg.Logger,
+			ProjectID:      cfg.ProjectID,
+			ServiceAccount: cfg.ServiceAccount,
+			KeyFile:        cfg.TokenSourceKeyFile,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return NewPubSub(ctx, cfg.ProjectID, ts)
+	case MQTT:
+		return NewMQTT(ctx, cfg.MQTTBroker, cfg.MQTTClientID)
+	default:
+		return nil, fmt.Errorf("unknown bus backend %q (want %q or %q)", cfg.Kind, PubSub, MQTT)
+	}
+}
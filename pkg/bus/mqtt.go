@@ -0,0 +1,153 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// MQTTBus is an MQTT 3.1.1/5.0 backed implementation of Bus, built on
+// github.com/eclipse/paho.golang. Topics map 1:1 onto fileup topic names and
+// every subscription uses QoS 1 with manual acknowledgement, matching the
+// at-least-once semantics of the PubSub backend.
+type MQTTBus struct {
+	client *paho.Client
+}
+
+// mqttMessage adapts a paho publish to the bus.Message interface. Ack sends
+// the acknowledgement through the client; Nack is a no-op that sends nothing,
+// leaving any redelivery to the broker's redelivery-on-reconnect behavior.
+type mqttMessage struct {
+	pb     *paho.Publish
+	client *paho.Client
+	ctx    context.Context
+}
+
+func (m mqttMessage) Data() []byte { return m.pb.Payload }
+
+func (m mqttMessage) Attributes() map[string]string {
+	attrs := map[string]string{}
+	if m.pb.Properties == nil {
+		return attrs
+	}
+	for _, p := range m.pb.Properties.User {
+		attrs[p.Key] = p.Value
+	}
+	return attrs
+}
+
+func (m mqttMessage) Ack() {
+	m.client.Ack(m.pb)
+}
+
+func (m mqttMessage) Nack() {
+	// paho.golang has no explicit PUBREC-reject path for QoS 1; leaving the
+	// message unacked relies on the broker's redelivery-on-reconnect behavior.
+}
+
+// sessionExpiryInterval is how long, in seconds, a v5 broker keeps this client's session (and
+// any QoS 1 messages queued for it) after the network connection drops. Per MQTT v5 §3.1.2.11.2
+// an absent Session Expiry Interval defaults to 0, which discards the session immediately on
+// disconnect regardless of CleanStart, so this must be set explicitly for CleanStart: false
+// below to actually preserve undelivered messages across a reconnect. An hour comfortably covers
+// a pod restart or rolling deploy without pinning the broker's memory to a subscriber that's
+// gone for good; NewMQTT callers that need longer should get a dedicated flag if that becomes
+// necessary.
+const sessionExpiryInterval = 60 * 60
+
+// NewMQTT dials brokerAddr (host:port) and returns a Bus backed by it. clientID identifies this
+// connection to the broker and must be stable across reconnects: combined with CleanStart:
+// false and sessionExpiryInterval below, it tells the broker to keep this client's session
+// (including any QoS 1 messages published while it was offline) instead of discarding it, which
+// is what lets Subscribe's at-least-once semantics survive a reconnect.
+func NewMQTT(ctx context.Context, brokerAddr, clientID string) (*MQTTBus, error) {
+	conn, err := net.Dial("tcp", brokerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial MQTT broker %s: %+v", brokerAddr, err)
+	}
+
+	client := paho.NewClient(paho.ClientConfig{Conn: conn})
+
+	expiry := uint32(sessionExpiryInterval)
+
+	cp := &paho.Connect{
+		KeepAlive:  30,
+		ClientID:   clientID,
+		CleanStart: false,
+		Properties: &paho.ConnectProperties{
+			SessionExpiryInterval: &expiry,
+		},
+	}
+
+	if _, err := client.Connect(ctx, cp); err != nil {
+		return nil, fmt.Errorf("unable to connect to MQTT broker %s: %+v", brokerAddr, err)
+	}
+
+	return &MQTTBus{client: client}, nil
+}
+
+// Publish sends data to topic at QoS 1, translating attrs into MQTT 5 user
+// properties so CloudEvents attributes survive the hop.
+func (b *MQTTBus) Publish(ctx context.Context, topic string, data []byte, attrs map[string]string) error {
+	props := &paho.PublishProperties{}
+	for k, v := range attrs {
+		props.User.Add(k, v)
+	}
+
+	_, err := b.client.Publish(ctx, &paho.Publish{
+		Topic:      topic,
+		QoS:        1,
+		Payload:    data,
+		Properties: props,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to publish to topic %s: %+v", topic, err)
+	}
+
+	return nil
+}
+
+// Subscribe registers handler for every message published to topic at QoS 1. subID is hashed
+// into an MQTT 5 Subscription Identifier, which the broker echoes back on every matching publish
+// so a client multiplexing several subscriptions onto one connection could tell them apart;
+// fileup's subscribers each use one Subscribe call per connection, so the identifier isn't read
+// back here, but setting a real one keeps the broker's subscription state (and this package's
+// behavior) matching its doc comments. Subscribe blocks until ctx is done.
+func (b *MQTTBus) Subscribe(ctx context.Context, topic, subID string, handler func(context.Context, Message)) error {
+	b.client.Router.RegisterHandler(topic, func(pb *paho.Publish) {
+		handler(ctx, mqttMessage{pb: pb, client: b.client, ctx: ctx})
+	})
+
+	id := subscriptionIdentifier(subID)
+
+	_, err := b.client.Subscribe(ctx, &paho.Subscribe{
+		Properties: &paho.SubscribeProperties{
+			SubscriptionIdentifier: &id,
+		},
+		Subscriptions: map[string]paho.SubscribeOptions{
+			topic: {QoS: 1},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to topic %s: %+v", topic, err)
+	}
+
+	<-ctx.Done()
+
+	return ctx.Err()
+}
+
+// subscriptionIdentifier derives a stable MQTT 5 Subscription Identifier (a non-zero value in
+// [1, 268435455], per the spec's variable byte integer encoding) from subID, so the same durable
+// subscription name always maps to the same identifier across restarts.
+func subscriptionIdentifier(subID string) int {
+	const max = 268435455
+
+	h := fnv.New32a()
+	h.Write([]byte(subID))
+
+	return int(h.Sum32()%max) + 1
+}
@@ -0,0 +1,96 @@
+package bus
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+)
+
+// PubSubBus is the Google PubSub backed implementation of Bus.
+type PubSubBus struct {
+	pc *pubsub.Client
+}
+
+// pubsubMessage adapts *pubsub.Message to the bus.Message interface.
+type pubsubMessage struct {
+	m *pubsub.Message
+}
+
+func (m pubsubMessage) Data() []byte                  { return m.m.Data }
+func (m pubsubMessage) Attributes() map[string]string { return m.m.Attributes }
+func (m pubsubMessage) Ack()                          { m.m.Ack() }
+func (m pubsubMessage) Nack()                         { m.m.Nack() }
+
+// NewPubSub creates a Bus backed by Google PubSub, authenticated with opts
+// (typically option.WithTokenSource wrapping a satokensource).
+func NewPubSub(ctx context.Context, projectID string, opts ...option.ClientOption) (*PubSubBus, error) {
+	pc, err := pubsub.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PubSubBus{pc: pc}, nil
+}
+
+func (b *PubSubBus) topic(ctx context.Context, name string) (*pubsub.Topic, error) {
+	t := b.pc.Topic(name)
+
+	ok, err := t.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		t, err = b.pc.CreateTopic(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// Publish publishes data and attrs to topic, creating it if it does not
+// already exist.
+func (b *PubSubBus) Publish(ctx context.Context, topic string, data []byte, attrs map[string]string) error {
+	t, err := b.topic(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	pr := t.Publish(ctx, &pubsub.Message{Data: data, Attributes: attrs})
+	_, err = pr.Get(ctx)
+	return err
+}
+
+// Subscribe creates (if necessary) a subscription named subID against topic
+// and delivers messages to handler until ctx is done.
+func (b *PubSubBus) Subscribe(ctx context.Context, topicName, subID string, handler func(context.Context, Message)) error {
+	t, err := b.topic(ctx, topicName)
+	if err != nil {
+		return err
+	}
+
+	sub := b.pc.Subscription(subID)
+
+	ok, err := sub.Exists(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		sub, err = b.pc.CreateSubscription(ctx, subID, pubsub.SubscriptionConfig{
+			Topic:       t,
+			AckDeadline: 60 * time.Second,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		handler(ctx, pubsubMessage{m: m})
+	})
+}
@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+
+	"github.com/wkharold/fileup/pkg/objectstore"
 )
 
 func Liveness(w http.ResponseWriter, r *http.Request) {
@@ -18,6 +22,42 @@ func MustGetenv(name string) string {
 	return val
 }
 
-func Readiness(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// Readiness returns an http.HandlerFunc for use as a readiness probe. It reports ready (200)
+// only if every check succeeds, stopping at the first failure and reporting 503 otherwise; with
+// no checks it always reports ready.
+func Readiness(checks ...func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, check := range checks {
+			if err := check(); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// LifecycleCheck returns a Readiness check that fails unless store's actual bucket lifecycle
+// policy matches want, catching a policy that failed to apply at startup or was overwritten
+// out-of-band. Stores that don't support lifecycle policies (GCS, Azure, B2) are skipped: their
+// expiration happens through an out-of-band mechanism Readiness has no way to inspect.
+func LifecycleCheck(ctx context.Context, store objectstore.Store, bucket string, want objectstore.LifecycleConfig) func() error {
+	return func() error {
+		lc, ok := store.(objectstore.Lifecycle)
+		if !ok {
+			return nil
+		}
+
+		got, err := lc.GetLifecycle(ctx, bucket)
+		if err != nil {
+			return fmt.Errorf("unable to read bucket lifecycle policy: %+v", err)
+		}
+
+		if got != want {
+			return fmt.Errorf("bucket lifecycle policy is %+v, want %+v", got, want)
+		}
+
+		return nil
+	}
 }
@@ -0,0 +1,255 @@
+// Package crypto provides envelope encryption for objects written to the
+// local object store. Each object is protected by its own random AES-256-GCM
+// data encryption key (DEK); the DEK itself is wrapped by a Cloud KMS key so
+// that only holders of KMS Decrypt permission on that key can ever recover
+// it.
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"github.com/wkharold/fileup/pkg/objectstore"
+	"github.com/wkharold/fileup/pkg/satokensource"
+	"github.com/wkharold/fileup/pkg/sdlog"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+)
+
+// Object store metadata keys used to carry the wrapped DEK alongside the
+// ciphertext. These follow the "X-Amz-Meta-*" convention most of our Store
+// backends echo back as bare object metadata keys (with the prefix
+// stripped).
+const (
+	MetaWrappedDEK = "X-Amz-Meta-Fileup-Wrapped-Dek"
+	MetaKeyVersion = "X-Amz-Meta-Fileup-Key-Version"
+
+	dekSize   = 32 // AES-256
+	nonceSize = 12 // standard GCM nonce
+)
+
+var (
+	ctx = context.Background()
+)
+
+// Encryptor envelope-encrypts object bodies with Cloud KMS, or passes them
+// through unchanged when no key resource name is configured.
+type Encryptor struct {
+	kc      *kms.KeyManagementClient
+	keyName string
+}
+
+// New creates an Encryptor that wraps data encryption keys under keyName (a
+// Cloud KMS resource name of the form
+// projects/*/locations/*/keyRings/*/cryptoKeys/*), authenticating to KMS
+// via the given service account and token source mode (see
+// satokensource.Config; an empty tsMode impersonates serviceAccount via the
+// IAM Credentials API, the historical default). If keyName is empty, the
+// returned Encryptor operates in passthrough mode: Seal and Open are no-ops.
+func New(logger *sdlog.StackdriverLogger, projectID, serviceAccount, keyName string, tsMode satokensource.Mode, tsKeyFile string) (*Encryptor, error) {
+	if keyName == "" {
+		return &Encryptor{}, nil
+	}
+
+	ts, err := satokensource.TokenSourceOption(ctx, satokensource.Config{
+		Mode:           tsMode,
+		Logger:         logger,
+		ProjectID:      projectID,
+		ServiceAccount: serviceAccount,
+		KeyFile:        tsKeyFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	kc, err := kms.NewKeyManagementClient(ctx, ts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create KMS client: %+v", err)
+	}
+
+	return &Encryptor{kc: kc, keyName: keyName}, nil
+}
+
+// Enabled reports whether this Encryptor wraps data encryption keys with
+// KMS, or is running in passthrough mode.
+func (e *Encryptor) Enabled() bool {
+	return e.kc != nil
+}
+
+// Seal reads all of plaintext, encrypts it with a freshly generated DEK, and
+// returns the ciphertext (nonce prepended) along with object store metadata
+// describing the wrapped DEK and KMS key version used. In passthrough mode
+// it returns plaintext unchanged and no metadata.
+func (e *Encryptor) Seal(ctx context.Context, plaintext io.Reader) (io.Reader, map[string]string, error) {
+	if !e.Enabled() {
+		return plaintext, nil, nil
+	}
+
+	bs, err := ioutil.ReadAll(plaintext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read plaintext: %+v", err)
+	}
+
+	dek := make([]byte, dekSize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, nil, fmt.Errorf("unable to generate data encryption key: %+v", err)
+	}
+
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, fmt.Errorf("unable to generate nonce: %+v", err)
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, bs, nil)
+
+	wrapped, err := e.kc.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:      e.keyName,
+		Plaintext: dek,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to wrap data encryption key with KMS: %+v", err)
+	}
+
+	meta := map[string]string{
+		MetaWrappedDEK: base64.StdEncoding.EncodeToString(wrapped.Ciphertext),
+		MetaKeyVersion: wrapped.Name,
+	}
+
+	return bytes.NewReader(ciphertext), meta, nil
+}
+
+// Open reverses Seal: given the ciphertext read from the object store and
+// the metadata Seal attached to it, it unwraps the DEK via KMS and decrypts
+// the object body. In passthrough mode (no metadata present) it returns
+// ciphertext unchanged.
+func (e *Encryptor) Open(ctx context.Context, ciphertext io.Reader, meta map[string]string) (io.Reader, error) {
+	wrappedDEK := meta[MetaWrappedDEK]
+	if wrappedDEK == "" {
+		return ciphertext, nil
+	}
+
+	if !e.Enabled() {
+		return nil, fmt.Errorf("object is encrypted but no KMS key is configured")
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedDEK)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode wrapped data encryption key: %+v", err)
+	}
+
+	unwrapped, err := e.kc.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:       e.keyName,
+		Ciphertext: wrapped,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data encryption key with KMS: %+v", err)
+	}
+
+	block, err := aes.NewCipher(unwrapped.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := ioutil.ReadAll(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ciphertext: %+v", err)
+	}
+
+	if len(bs) < nonceSize {
+		return nil, fmt.Errorf("ciphertext too short to contain a nonce")
+	}
+
+	nonce, sealed := bs[:nonceSize], bs[nonceSize:]
+
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt object: %+v", err)
+	}
+
+	return bytes.NewReader(plaintext), nil
+}
+
+// GetObjectSSE behaves like GetObject, but fetches bucket/object through the server-side
+// encryption sse describes instead of a plain store.Get, for objects protected by both this
+// Encryptor's envelope encryption and object-store-managed SSE-C/SSE-KMS. store must implement
+// objectstore.ServerSideEncryption unless sse is in objectstore.SSENone mode.
+func (e *Encryptor) GetObjectSSE(store objectstore.Store, sse objectstore.SSEConfig, bucket, object string) (io.Reader, error) {
+	if sse.Mode == objectstore.SSENone {
+		return e.GetObject(store, bucket, object)
+	}
+
+	sses, ok := store.(objectstore.ServerSideEncryption)
+	if !ok {
+		return nil, fmt.Errorf("object store does not support server-side encryption")
+	}
+
+	obj, err := sses.GetEncrypted(ctx, bucket, object, sse)
+	if err != nil {
+		return nil, err
+	}
+
+	if !e.Enabled() {
+		return obj, nil
+	}
+
+	info, err := store.Stat(ctx, bucket, object)
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat %s/%s: %+v", bucket, object, err)
+	}
+
+	meta := map[string]string{
+		MetaWrappedDEK: info.Metadata[MetaWrappedDEK],
+		MetaKeyVersion: info.Metadata[MetaKeyVersion],
+	}
+
+	return e.Open(ctx, obj, meta)
+}
+
+// GetObject is a drop-in replacement for store.Get that transparently
+// decrypts objects sealed with Seal. Callers (recognizer, labeler, archiver)
+// use this instead of calling store.Get directly so they don't need to know
+// whether the bucket holds encrypted or plaintext objects.
+func (e *Encryptor) GetObject(store objectstore.Store, bucket, object string) (io.Reader, error) {
+	obj, err := store.Get(ctx, bucket, object)
+	if err != nil {
+		return nil, err
+	}
+
+	if !e.Enabled() {
+		return obj, nil
+	}
+
+	info, err := store.Stat(ctx, bucket, object)
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat %s/%s: %+v", bucket, object, err)
+	}
+
+	meta := map[string]string{
+		MetaWrappedDEK: info.Metadata[MetaWrappedDEK],
+		MetaKeyVersion: info.Metadata[MetaKeyVersion],
+	}
+
+	return e.Open(ctx, obj, meta)
+}
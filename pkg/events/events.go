@@ -0,0 +1,211 @@
+// Package events defines the CloudEvents envelope used for every message
+// published between the fileup microservices (receiver, recognizer, labeler,
+// purger, archiver) and provides helpers to publish and parse that envelope
+// over a pkg/bus transport using the CloudEvents structured content mode.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/wkharold/fileup/pkg/bus"
+	"github.com/wkharold/fileup/pkg/sdlog"
+)
+
+// Event types published by the fileup pipeline.
+const (
+	TypeImageReceived   = "com.fileup.image.received.v1"
+	TypeImageLabeled    = "com.fileup.image.labeled.v1"
+	TypeImageRecognized = "com.fileup.image.recognized.v1"
+	TypeImagePurge      = "com.fileup.image.purge.v1"
+
+	contentType = "application/cloudevents+json"
+)
+
+// ImageData is the payload carried by image.received, image.recognized, and
+// image.purge events.
+type ImageData struct {
+	Bucket      string `json:"bucket"`
+	Object      string `json:"object"`
+	SHA256      string `json:"sha256,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+
+	// SSEKeyID identifies the server-side encryption key (a KMS key resource
+	// name in sse-kms mode, a customer-key fingerprint in sse-c mode)
+	// protecting the object, if any. It never carries key material.
+	SSEKeyID string `json:"sseKeyId,omitempty"`
+
+	// Uploader is the authenticated identity (see auth.User) that uploaded the object, if the
+	// uploader endpoint that received it required authentication. Empty when auth is disabled.
+	Uploader string `json:"uploader,omitempty"`
+}
+
+// LabeledImageData is the payload carried by image.labeled events.
+type LabeledImageData struct {
+	Bucket   string   `json:"bucket"`
+	Object   string   `json:"object"`
+	Labels   []string `json:"labels"`
+	Uploader string   `json:"uploader,omitempty"`
+}
+
+// New creates a CloudEvents v1.0 event of the given type and source with data
+// as its JSON-encoded payload.
+func New(eventType, source string, data interface{}) (cloudevents.Event, error) {
+	ev := cloudevents.NewEvent()
+
+	ev.SetID(uuid.New().String())
+	ev.SetSource(source)
+	ev.SetType(eventType)
+
+	if err := ev.SetData(contentType, data); err != nil {
+		return cloudevents.Event{}, fmt.Errorf("unable to set event data: %+v", err)
+	}
+
+	return ev, nil
+}
+
+// Validate checks that ev carries the fields every subscriber in this codebase relies on
+// (events.Parse/DataAs assume a well-formed envelope and do not re-check them), returning an
+// error describing the first one missing. Publish and PublishWithTrace call it before
+// publishing so a mangled event never reaches the topic.
+func Validate(ev cloudevents.Event) error {
+	if ev.ID() == "" {
+		return fmt.Errorf("event is missing an id")
+	}
+	if ev.Source() == "" {
+		return fmt.Errorf("event %s is missing a source", ev.ID())
+	}
+	if ev.Type() == "" {
+		return fmt.Errorf("event %s is missing a type", ev.ID())
+	}
+	if ev.SpecVersion() == "" {
+		return fmt.Errorf("event %s is missing a spec version", ev.ID())
+	}
+	if len(ev.Data()) == 0 {
+		return fmt.Errorf("event %s has no data", ev.ID())
+	}
+
+	return nil
+}
+
+// attributes returns the PubSub/MQTT message attributes carried alongside ev,
+// letting subscribers filter on event type, source, and content type without
+// decoding the envelope.
+func attributes(ev cloudevents.Event) map[string]string {
+	attrs := map[string]string{
+		"ce-id":           ev.ID(),
+		"ce-source":       ev.Source(),
+		"ce-specversion":  ev.SpecVersion(),
+		"ce-type":         ev.Type(),
+		"content-type":    contentType,
+		"datacontenttype": ev.DataContentType(),
+	}
+
+	trace, spanID := Trace(ev)
+	if trace != "" {
+		attrs["ce-traceid"] = trace
+	}
+	if spanID != "" {
+		attrs["ce-spanid"] = spanID
+	}
+
+	return attrs
+}
+
+// Trace extracts the Cloud Trace trace and span ids stamped on ev by
+// PublishWithTrace, if any.
+func Trace(ev cloudevents.Event) (trace, spanID string) {
+	if v, ok := ev.Extensions()["traceid"].(string); ok {
+		trace = v
+	}
+	if v, ok := ev.Extensions()["spanid"].(string); ok {
+		spanID = v
+	}
+	return trace, spanID
+}
+
+// Publish wraps data in a CloudEvents envelope of the given type and source
+// and publishes it to topic via pub in structured content mode, returning the
+// CloudEvents id once the publish is acknowledged.
+func Publish(ctx context.Context, pub bus.Publisher, topic, eventType, source string, data interface{}) (string, error) {
+	return PublishWithTrace(ctx, pub, topic, eventType, source, data, "", "")
+}
+
+// PublishWithTrace behaves like Publish, additionally stamping the CloudEvents envelope with
+// the given Cloud Trace trace and span ids (as "traceid"/"spanid" extensions and mirrored
+// "ce-traceid"/"ce-spanid" message attributes) so that a downstream Receive callback can recover
+// them via Trace and correlate its own log entries with the request that triggered it.
+func PublishWithTrace(ctx context.Context, pub bus.Publisher, topic, eventType, source string, data interface{}, trace, spanID string) (string, error) {
+	return publish(ctx, pub, topic, eventType, source, data, trace, spanID, nil)
+}
+
+// PublishWithAttributes behaves like PublishWithTrace, additionally merging attrs into the
+// message attributes alongside the standard ce-* ones, so a subscriber can filter on
+// caller-specific context (e.g. which rule produced the event) without decoding the envelope.
+func PublishWithAttributes(ctx context.Context, pub bus.Publisher, topic, eventType, source string, data interface{}, trace, spanID string, attrs map[string]string) (string, error) {
+	return publish(ctx, pub, topic, eventType, source, data, trace, spanID, attrs)
+}
+
+func publish(ctx context.Context, pub bus.Publisher, topic, eventType, source string, data interface{}, trace, spanID string, extra map[string]string) (string, error) {
+	ev, err := New(eventType, source, data)
+	if err != nil {
+		return "", err
+	}
+
+	if trace != "" {
+		ev.SetExtension("traceid", trace)
+	}
+	if spanID != "" {
+		ev.SetExtension("spanid", spanID)
+	}
+
+	if err := Validate(ev); err != nil {
+		return "", fmt.Errorf("refusing to publish a malformed event: %+v", err)
+	}
+
+	bs, err := json.Marshal(ev)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal event %s: %+v", ev.ID(), err)
+	}
+
+	attrs := attributes(ev)
+	for k, v := range extra {
+		attrs[k] = v
+	}
+
+	if err := pub.Publish(ctx, topic, bs, attrs); err != nil {
+		return "", fmt.Errorf("unable to publish event %s to topic %s: %+v", ev.ID(), topic, err)
+	}
+
+	return ev.ID(), nil
+}
+
+// Parse unwraps the CloudEvents envelope carried in a bus message.
+func Parse(m bus.Message) (cloudevents.Event, error) {
+	ev := cloudevents.NewEvent()
+
+	if err := json.Unmarshal(m.Data(), &ev); err != nil {
+		return cloudevents.Event{}, fmt.Errorf("unable to parse CloudEvents envelope: %+v", err)
+	}
+
+	return ev, nil
+}
+
+// DataAs unmarshals the CloudEvents data payload of ev into v.
+func DataAs(ev cloudevents.Event, v interface{}) error {
+	return json.Unmarshal(ev.Data(), v)
+}
+
+// Log records the id, type, and source of ev via logger so that downstream
+// services can be correlated in Stackdriver by event id.
+func Log(logger *sdlog.StackdriverLogger, ev cloudevents.Event) {
+	logger.Info(fmt.Sprintf("event %s", ev.ID()), map[string]interface{}{
+		"event_id": ev.ID(),
+		"type":     ev.Type(),
+		"source":   ev.Source(),
+	})
+}
@@ -1,92 +1,70 @@
 // Package labeler provides the constructor and ReceiveAndProcess method for the labeler microservice.
 // The labeler microservice is responsible for labeling images using the Google Vision API. It publishes
-// a message associating an image with its top three labels to its Google PubSub topic.
+// a message associating an image with its top three labels to its message bus topic.
 package labeler
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"strings"
-	"time"
 
-	"cloud.google.com/go/pubsub"
 	vision "cloud.google.com/go/vision/apiv1"
-	minio "github.com/minio/minio-go"
+	"github.com/wkharold/fileup/pkg/bus"
+	"github.com/wkharold/fileup/pkg/crypto"
+	"github.com/wkharold/fileup/pkg/events"
+	"github.com/wkharold/fileup/pkg/objectstore"
 	"github.com/wkharold/fileup/pkg/satokensource"
 	"github.com/wkharold/fileup/pkg/sdlog"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	iam "google.golang.org/api/iam/v1"
-	"google.golang.org/api/option"
 	vpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
 )
 
 // A Labeler uses the Google Vision API to get the top three labels associated
 // the a given image. It posts a message associating those labels with the image
-// to its pubsub topic.
+// to its message bus topic.
 type Labeler struct {
 	logger *sdlog.StackdriverLogger
 	iac    *vision.ImageAnnotatorClient
-	mc     *minio.Client
-	topic  *pubsub.Topic
-	sub    *pubsub.Subscription
+	store  objectstore.Store
+	enc    *crypto.Encryptor
+	bus    bus.Bus
+	it     string
+	lt     string
 }
 
-// LabeledImage associates an image, located in the local store, with a set of labels.
-type LabeledImage struct {
-	Location string   `json:"location"`
-	Labels   []string `json:"labels"`
-}
+const source = "fileup/labeler"
 
 var (
 	ctx = context.Background()
 )
 
-// New creates and initializes a Labeler. The labeler will use the specified serviceAccount
-// to subscribe to the imageTopic and publish to the labeledTopic.
-func New(logger *sdlog.StackdriverLogger, mc *minio.Client, projectID, serviceAccount, imageTopic, labeledTopic string) (*Labeler, error) {
-	client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
-	if err != nil {
-		return nil, err
-	}
-
+// New creates and initializes a Labeler. The labeler subscribes to imageTopic and publishes to
+// labeledTopic via b, so the pipeline can run against any bus.Bus backend (Google PubSub, MQTT, ...).
+// tsMode and tsKeyFile select how Vision API tokens are minted; see satokensource.Config.
+func New(logger *sdlog.StackdriverLogger, store objectstore.Store, enc *crypto.Encryptor, projectID, serviceAccount string, b bus.Bus, imageTopic, labeledTopic string, tsMode satokensource.Mode, tsKeyFile string) (*Labeler, error) {
 	labeler := &Labeler{
 		logger: logger,
-		mc:     mc,
-	}
-
-	ts := option.WithTokenSource(oauth2.ReuseTokenSource(nil, satokensource.New(client, logger, projectID, serviceAccount)))
-
-	labeler.iac, err = vision.NewImageAnnotatorClient(ctx, ts)
-	if err != nil {
-		return nil, err
+		store:  store,
+		enc:    enc,
+		bus:    b,
+		it:     imageTopic,
+		lt:     labeledTopic,
 	}
 
-	pc, err := pubsub.NewClient(ctx, projectID, ts)
+	ts, err := satokensource.TokenSourceOption(ctx, satokensource.Config{
+		Mode:           tsMode,
+		Logger:         logger,
+		ProjectID:      projectID,
+		ServiceAccount: serviceAccount,
+		KeyFile:        tsKeyFile,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	labeler.sub = pc.Subscription(imageTopic)
-
-	ok, err := labeler.sub.Exists(ctx)
+	labeler.iac, err = vision.NewImageAnnotatorClient(ctx, ts)
 	if err != nil {
 		return nil, err
 	}
 
-	if !ok {
-		labeler.sub, err = pc.CreateSubscription(ctx, imageTopic, pubsub.SubscriptionConfig{
-			Topic:       pc.Topic(imageTopic),
-			AckDeadline: 60 * time.Second,
-		})
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	labeler.topic = pc.Topic(labeledTopic)
-
 	return labeler, nil
 }
 
@@ -94,39 +72,50 @@ func New(logger *sdlog.StackdriverLogger, mc *minio.Client, projectID, serviceAc
 // labels for the image from the Google Vision API and then publishing a message associating
 // the image with those labels to the labeled topic.
 func (l Labeler) ReceiveAndProcess(ctx context.Context) {
-	err := l.sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+	err := l.bus.Subscribe(ctx, l.it, l.it, func(ctx context.Context, m bus.Message) {
 		defer m.Ack()
 
-		mparts := strings.Split(string(m.Data), "/")
-		if len(mparts) != 2 {
-			l.logger.LogError("Bad message", fmt.Errorf("Message must have format <bucket/image> [%s]", string(m.Data)))
+		ev, err := events.Parse(m)
+		if err != nil {
+			l.logger.LogError("Bad message", err)
+			return
+		}
+
+		trace, spanID := events.Trace(ev)
+		logger := l.logger.WithTrace(trace, spanID)
+		events.Log(logger, ev)
+
+		var img events.ImageData
+		if err := events.DataAs(ev, &img); err != nil {
+			logger.LogError(fmt.Sprintf("Unable to decode event %s", ev.ID()), err)
 			return
 		}
+		logger = logger.WithFields(map[string]interface{}{"bucket": img.Bucket, "object": img.Object})
 
-		labels, err := l.labelImage(mparts[0], mparts[1])
+		labels, err := l.labelImage(img.Bucket, img.Object)
 		if err != nil {
-			l.logger.LogError(fmt.Sprintf("Unable to recognize %s", string(m.Data)), err)
+			logger.LogError(fmt.Sprintf("Unable to recognize %s/%s", img.Bucket, img.Object), err)
 			return
 		}
 
 		if len(labels) == 0 {
-			l.logger.LogInfo(fmt.Sprintf("No labels for %s", string(m.Data)))
+			logger.LogInfo(fmt.Sprintf("No labels for %s/%s", img.Bucket, img.Object))
 			return
 		}
 
-		if err = sendNotification(l.logger, l.topic, labels, string(m.Data)); err != nil {
-			l.logger.LogError("Unable to send notification", err)
+		if err = sendNotification(l.bus, logger, l.lt, img.Bucket, img.Object, img.Uploader, labels, trace, spanID); err != nil {
+			logger.LogError("Unable to send notification", err)
 		}
 	})
 	if err != context.Canceled {
-		l.logger.LogError(fmt.Sprintf("Unable to receive from %s", l.sub.ID()), err)
+		l.logger.LogError(fmt.Sprintf("Unable to receive from %s", l.it), err)
 	}
 }
 
 func (l Labeler) labelImage(bucket, image string) ([]string, error) {
 	labels := []string{}
 
-	obj, err := l.mc.GetObject(bucket, image)
+	obj, err := l.enc.GetObject(l.store, bucket, image)
 	if err != nil {
 		return labels, err
 	}
@@ -153,21 +142,18 @@ func (l Labeler) labelImage(bucket, image string) ([]string, error) {
 	return labels, nil
 }
 
-func sendNotification(logger *sdlog.StackdriverLogger, topic *pubsub.Topic, labels []string, location string) error {
-	bs, err := json.Marshal(&LabeledImage{Location: location, Labels: labels})
-	if err != nil {
-		return err
-	}
-
-	msg := &pubsub.Message{Data: bs}
-
-	pr := topic.Publish(ctx, msg)
-	id, err := pr.Get(ctx)
+func sendNotification(pub bus.Publisher, logger *sdlog.StackdriverLogger, topic, bucket, object, uploader string, labels []string, trace, spanID string) error {
+	id, err := events.PublishWithTrace(ctx, pub, topic, events.TypeImageLabeled, source, events.LabeledImageData{
+		Bucket:   bucket,
+		Object:   object,
+		Labels:   labels,
+		Uploader: uploader,
+	}, trace, spanID)
 	if err != nil {
 		return fmt.Errorf("Unable publish to send notification to topic %s [%+v]", topic, err)
 	}
 
-	logger.LogInfo(fmt.Sprintf("published message %s to topic %s [%s]", id, topic, string(msg.Data)))
+	logger.LogInfo(fmt.Sprintf("published event %s to topic %s [%s/%s]", id, topic, bucket, object))
 
 	return nil
 }
@@ -0,0 +1,142 @@
+package objectstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// AzureStore is the Azure Blob Storage backed implementation of Store,
+// authenticated with a storage account name and shared key.
+type AzureStore struct {
+	account string
+	cred    *azblob.SharedKeyCredential
+	p       azblob.Pipeline
+}
+
+// NewAzure creates a Store backed by Azure Blob Storage, authenticated with
+// the shared key for the given storage account.
+func NewAzure(account, key string) (*AzureStore, error) {
+	cred, err := azblob.NewSharedKeyCredential(account, key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Azure shared key credential: %+v", err)
+	}
+
+	return &AzureStore{
+		account: account,
+		cred:    cred,
+		p:       azblob.NewPipeline(cred, azblob.PipelineOptions{}),
+	}, nil
+}
+
+func (s *AzureStore) containerURL(container string) azblob.ContainerURL {
+	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", s.account, container))
+	return azblob.NewContainerURL(*u, s.p)
+}
+
+func (s *AzureStore) blockBlobURL(container, key string) azblob.BlockBlobURL {
+	return s.containerURL(container).NewBlockBlobURL(key)
+}
+
+func (s *AzureStore) Put(ctx context.Context, bucket, key string, r io.Reader, contentType string, metadata map[string]string) error {
+	_, err := azblob.UploadStreamToBlockBlob(ctx, r, s.blockBlobURL(bucket, key), azblob.UploadStreamToBlockBlobOptions{
+		BufferSize: 4 * 1024 * 1024,
+		MaxBuffers: 4,
+		Metadata:   metadata,
+		BlobHTTPHeaders: azblob.BlobHTTPHeaders{
+			ContentType: contentType,
+		},
+	})
+	return err
+}
+
+func (s *AzureStore) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	resp, err := s.blockBlobURL(bucket, key).Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+func (s *AzureStore) Stat(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	props, err := s.blockBlobURL(bucket, key).GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{
+		Key:          key,
+		Size:         props.ContentLength(),
+		LastModified: props.LastModified(),
+		ContentType:  props.ContentType(),
+		Metadata:     props.NewMetadata(),
+	}, nil
+}
+
+func (s *AzureStore) List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	infos := []ObjectInfo{}
+	container := s.containerURL(bucket)
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		resp, err := container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range resp.Segment.BlobItems {
+			infos = append(infos, ObjectInfo{
+				Key:          b.Name,
+				Size:         *b.Properties.ContentLength,
+				LastModified: b.Properties.LastModified,
+				ContentType:  *b.Properties.ContentType,
+				Metadata:     b.Metadata,
+			})
+		}
+
+		marker = resp.NextMarker
+	}
+
+	return infos, nil
+}
+
+func (s *AzureStore) Remove(ctx context.Context, bucket, key string) error {
+	_, err := s.blockBlobURL(bucket, key).Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	return err
+}
+
+func (s *AzureStore) Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string) error {
+	src := s.blockBlobURL(srcBucket, srcKey).URL()
+
+	_, err := s.blockBlobURL(dstBucket, dstKey).StartCopyFromURL(ctx, src, nil, azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil)
+	return err
+}
+
+// Presign mints a blob SAS URL for bucket/key, scoped to read or write
+// depending on method, signed with the storage account's shared key.
+func (s *AzureStore) Presign(ctx context.Context, bucket, key string, method PresignMethod, expiry time.Duration) (string, error) {
+	perms := azblob.BlobSASPermissions{Read: true}
+	if method == PresignPut {
+		perms = azblob.BlobSASPermissions{Create: true, Write: true}
+	}
+
+	sas, err := azblob.BlobSASSignatureValues{
+		Protocol:      azblob.SASProtocolHTTPS,
+		ExpiryTime:    time.Now().Add(expiry),
+		ContainerName: bucket,
+		BlobName:      key,
+		Permissions:   perms.String(),
+	}.NewSASQueryParameters(s.cred)
+	if err != nil {
+		return "", fmt.Errorf("unable to sign SAS URL for %s/%s: %+v", bucket, key, err)
+	}
+
+	u := s.blockBlobURL(bucket, key).URL()
+	u.RawQuery = sas.Encode()
+
+	return u.String(), nil
+}
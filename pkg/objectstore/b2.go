@@ -0,0 +1,147 @@
+package objectstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// B2Store is the Backblaze B2 backed implementation of Store.
+type B2Store struct {
+	client *b2.Client
+}
+
+// NewB2 creates a Store backed by Backblaze B2, authenticated with the
+// given account ID and application key.
+func NewB2(ctx context.Context, accountID, applicationKey string) (*B2Store, error) {
+	client, err := b2.NewClient(ctx, accountID, applicationKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to authenticate to B2: %+v", err)
+	}
+
+	return &B2Store{client: client}, nil
+}
+
+func (s *B2Store) bucket(ctx context.Context, name string) (*b2.Bucket, error) {
+	bucket, err := s.client.Bucket(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open B2 bucket %s: %+v", name, err)
+	}
+
+	return bucket, nil
+}
+
+func (s *B2Store) Put(ctx context.Context, bucket, key string, r io.Reader, contentType string, metadata map[string]string) error {
+	b, err := s.bucket(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	w := b.Object(key).NewWriter(ctx)
+	w.ContentType = contentType
+	w.Info = metadata
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func (s *B2Store) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	b, err := s.bucket(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Object(key).NewReader(ctx), nil
+}
+
+func (s *B2Store) Stat(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	b, err := s.bucket(ctx, bucket)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	attrs, err := b.Object(key).Attrs(ctx)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{
+		Key:          attrs.Name,
+		Size:         attrs.Size,
+		LastModified: attrs.UploadTimestamp,
+		ContentType:  attrs.ContentType,
+		Metadata:     attrs.Info,
+	}, nil
+}
+
+func (s *B2Store) List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	b, err := s.bucket(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []ObjectInfo{}
+
+	it := b.List(ctx, b2.ListPrefix(prefix))
+	for it.Next() {
+		attrs, err := it.Object().Attrs(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, ObjectInfo{
+			Key:          attrs.Name,
+			Size:         attrs.Size,
+			LastModified: attrs.UploadTimestamp,
+			ContentType:  attrs.ContentType,
+			Metadata:     attrs.Info,
+		})
+	}
+
+	return infos, it.Err()
+}
+
+func (s *B2Store) Remove(ctx context.Context, bucket, key string) error {
+	b, err := s.bucket(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	return b.Object(key).Delete(ctx)
+}
+
+// Copy reads srcBucket/srcKey and writes it back out to dstBucket/dstKey; B2
+// has no server-side copy API exposed through blazer, so this always goes
+// through the client.
+func (s *B2Store) Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string) error {
+	r, err := s.Get(ctx, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return s.Put(ctx, dstBucket, dstKey, r, "application/octet-stream", nil)
+}
+
+// Presign mints a time-limited download authorization token for bucket/key.
+// B2 has no equivalent presigned-upload mechanism, so method must be
+// PresignGet.
+func (s *B2Store) Presign(ctx context.Context, bucket, key string, method PresignMethod, expiry time.Duration) (string, error) {
+	if method != PresignGet {
+		return "", fmt.Errorf("B2 does not support presigned %s URLs", method)
+	}
+
+	b, err := s.bucket(ctx, bucket)
+	if err != nil {
+		return "", err
+	}
+
+	return b.Object(key).AuthURL(ctx, expiry, key)
+}
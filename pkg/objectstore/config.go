@@ -0,0 +1,82 @@
+package objectstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/wkharold/fileup/pkg/satokensource"
+	"github.com/wkharold/fileup/pkg/sdlog"
+	"github.com/wkharold/fileup/pkg/tokensource"
+)
+
+// Backend names accepted by the --backend flag on every cmd/* binary that
+// reads or writes objects.
+const (
+	MinIO = "minio" // also serves plain S3 and S3-compatible endpoints
+	GCS   = "gcs"
+	Azure = "azure"
+	B2    = "b2"
+)
+
+// Config selects and parameterizes the Store backend a microservice binary
+// opens. Only the fields relevant to Kind need be set.
+type Config struct {
+	// Kind is one of MinIO, GCS, Azure, or B2.
+	Kind string
+
+	// Endpoint, AccessKeyID, SecretAccessKey, and UseSSL configure the
+	// MinIO backend, which also speaks plain S3 and S3-compatible APIs
+	// when Endpoint points at one.
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	UseSSL          bool
+
+	// MinIOSTSEndpoint, MinIOSTSSigner, and MinIOSTSPolicy configure the MinIO backend to
+	// fetch scoped, short-lived credentials from a Security Token Service via
+	// AssumeRoleWithWebIdentity instead of the static AccessKeyID/SecretAccessKey pair above.
+	// MinIOSTSEndpoint being non-empty selects this mode.
+	MinIOSTSEndpoint string
+	MinIOSTSSigner   tokensource.Signer
+	MinIOSTSPolicy   string
+
+	// ProjectID and ServiceAccount authenticate the GCS backend.
+	ProjectID      string
+	ServiceAccount string
+	Logger         *sdlog.StackdriverLogger
+
+	// TokenSourceMode and TokenSourceKeyFile select how the GCS backend mints OAuth2 tokens;
+	// see satokensource.Config. An empty TokenSourceMode preserves the historical behavior of
+	// impersonating ServiceAccount via the IAM Credentials API.
+	TokenSourceMode    satokensource.Mode
+	TokenSourceKeyFile string
+
+	// AzureAccount and AzureKey authenticate the Azure backend.
+	AzureAccount string
+	AzureKey     string
+
+	// B2AccountID and B2ApplicationKey authenticate the Backblaze B2
+	// backend.
+	B2AccountID      string
+	B2ApplicationKey string
+}
+
+// New constructs the Store selected by cfg.Kind.
+func New(ctx context.Context, cfg Config) (Store, error) {
+	switch cfg.Kind {
+	case "", MinIO:
+		if cfg.MinIOSTSEndpoint != "" {
+			provider := tokensource.NewMinIOSTS(cfg.MinIOSTSEndpoint, cfg.MinIOSTSSigner, cfg.MinIOSTSPolicy)
+			return NewMinIOWithSTS(cfg.Endpoint, provider, cfg.UseSSL)
+		}
+		return NewMinIO(cfg.Endpoint, cfg.AccessKeyID, cfg.SecretAccessKey, cfg.UseSSL)
+	case GCS:
+		return NewGCS(ctx, cfg.Logger, cfg.ProjectID, cfg.ServiceAccount, cfg.TokenSourceMode, cfg.TokenSourceKeyFile)
+	case Azure:
+		return NewAzure(cfg.AzureAccount, cfg.AzureKey)
+	case B2:
+		return NewB2(ctx, cfg.B2AccountID, cfg.B2ApplicationKey)
+	default:
+		return nil, fmt.Errorf("unknown object store backend %q (want %q, %q, %q, or %q)", cfg.Kind, MinIO, GCS, Azure, B2)
+	}
+}
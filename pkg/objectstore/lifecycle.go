@@ -0,0 +1,26 @@
+package objectstore
+
+import "context"
+
+// LifecycleConfig describes the retention policy applied to a bucket: objects older than
+// ExpireDays are deleted, incomplete multipart uploads older than AbortMultipartDays are
+// aborted, and (if TransitionDays is non-zero) objects older than TransitionDays are moved to
+// TransitionStorageClass. A zero field disables that action.
+type LifecycleConfig struct {
+	ExpireDays             int
+	AbortMultipartDays     int
+	TransitionDays         int
+	TransitionStorageClass string
+}
+
+// A Lifecycle is implemented by Store backends that support S3-style bucket lifecycle
+// policies (MinIO/S3), as opposed to backends that expire objects through an out-of-band
+// mechanism (GCS, Azure, B2). Callers that need to manage lifecycle policy should type-assert
+// a Store for this interface rather than assuming it's present.
+type Lifecycle interface {
+	// SetLifecycle applies cfg as the bucket's lifecycle policy, replacing any existing one.
+	SetLifecycle(ctx context.Context, bucket string, cfg LifecycleConfig) error
+
+	// GetLifecycle returns the bucket's current lifecycle policy.
+	GetLifecycle(ctx context.Context, bucket string) (LifecycleConfig, error)
+}
@@ -0,0 +1,341 @@
+package objectstore
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/minio/minio-go/pkg/encrypt"
+)
+
+// minioRegion is the region new buckets are created in; MinIO ignores this
+// outside of real S3.
+const minioRegion = "us-east-1"
+
+// MinIOStore is the MinIO/S3 backed implementation of Store. Pointing
+// Endpoint at Amazon S3 (or any S3-compatible service) works unmodified,
+// since minio-go speaks the S3 API.
+type MinIOStore struct {
+	mc *minio.Client
+}
+
+// NewMinIO creates a Store backed by the MinIO/S3 endpoint at endpoint,
+// authenticated with accessKeyID/secretAccessKey.
+func NewMinIO(endpoint, accessKeyID, secretAccessKey string, useSSL bool) (*MinIOStore, error) {
+	mc, err := minio.New(endpoint, accessKeyID, secretAccessKey, useSSL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to MinIO/S3 endpoint %s: %+v", endpoint, err)
+	}
+
+	return &MinIOStore{mc: mc}, nil
+}
+
+// NewMinIOWithSTS creates a Store backed by the MinIO/S3 endpoint at endpoint, authenticating
+// with credentials minted by provider (typically a tokensource.MinIOSTSProvider) instead of a
+// static access/secret key pair. provider is re-invoked automatically whenever its credentials
+// expire.
+func NewMinIOWithSTS(endpoint string, provider credentials.Provider, useSSL bool) (*MinIOStore, error) {
+	mc, err := minio.NewWithCredentials(endpoint, credentials.New(provider), useSSL, minioRegion)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to MinIO/S3 endpoint %s: %+v", endpoint, err)
+	}
+
+	return &MinIOStore{mc: mc}, nil
+}
+
+func (s *MinIOStore) Put(ctx context.Context, bucket, key string, r io.Reader, contentType string, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		_, err := s.mc.PutObject(bucket, key, r, contentType)
+		return err
+	}
+
+	usermeta := make(map[string][]string, len(metadata)+1)
+	for k, v := range metadata {
+		usermeta[k] = []string{v}
+	}
+	usermeta["Content-Type"] = []string{contentType}
+
+	_, err := s.mc.PutObjectWithMetadata(bucket, key, r, usermeta, nil)
+	return err
+}
+
+func (s *MinIOStore) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	return s.mc.GetObject(bucket, key)
+}
+
+func (s *MinIOStore) Stat(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	info, err := s.mc.StatObject(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return objectInfo(info), nil
+}
+
+func (s *MinIOStore) List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	infos := []ObjectInfo{}
+	for obj := range s.mc.ListObjectsV2(bucket, prefix, true, done) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		infos = append(infos, objectInfo(obj))
+	}
+
+	return infos, nil
+}
+
+func (s *MinIOStore) Remove(ctx context.Context, bucket, key string) error {
+	return s.mc.RemoveObject(bucket, key)
+}
+
+// Copy reads srcBucket/srcKey and writes it back out to dstBucket/dstKey;
+// minio-go's server-side CopyObject can't span two independently configured
+// clients, so this always goes through the client doing the Copy call.
+func (s *MinIOStore) Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string) error {
+	obj, err := s.mc.GetObject(srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	info, err := s.mc.StatObject(srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.mc.PutObject(dstBucket, dstKey, obj, info.ContentType)
+	return err
+}
+
+// EnsureBucket creates bucket in the "us-east-1" region if it does not
+// already exist, satisfying objectstore.BucketLifecycle.
+func (s *MinIOStore) EnsureBucket(ctx context.Context, bucket string) error {
+	exists, err := s.mc.BucketExists(bucket)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	return s.mc.MakeBucket(bucket, minioRegion)
+}
+
+// RemoveBucket deletes bucket, satisfying objectstore.BucketLifecycle.
+func (s *MinIOStore) RemoveBucket(ctx context.Context, bucket string) error {
+	return s.mc.RemoveBucket(bucket)
+}
+
+func (s *MinIOStore) Presign(ctx context.Context, bucket, key string, method PresignMethod, expiry time.Duration) (string, error) {
+	var (
+		u   *url.URL
+		err error
+	)
+
+	switch method {
+	case PresignGet:
+		u, err = s.mc.PresignedGetObject(bucket, key, expiry, url.Values{})
+	case PresignPut:
+		u, err = s.mc.PresignedPutObject(bucket, key, expiry)
+	default:
+		return "", fmt.Errorf("unsupported presign method %q", method)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+// lifecycleRuleID names the single Rule SetLifecycle writes; GetLifecycle only looks at this
+// rule and ignores any other. SetLifecycle replaces the bucket's whole lifecycle policy, so
+// rules applied by another process do not survive it.
+const lifecycleRuleID = "fileup-default"
+
+type lifecycleXML struct {
+	XMLName xml.Name           `xml:"LifecycleConfiguration"`
+	Rules   []lifecycleXMLRule `xml:"Rule"`
+}
+
+type lifecycleXMLRule struct {
+	ID                             string                   `xml:"ID"`
+	Status                         string                   `xml:"Status"`
+	Expiration                     *lifecycleXMLExpiration  `xml:"Expiration,omitempty"`
+	Transition                     *lifecycleXMLTransition  `xml:"Transition,omitempty"`
+	AbortIncompleteMultipartUpload *lifecycleXMLAbortUpload `xml:"AbortIncompleteMultipartUpload,omitempty"`
+}
+
+type lifecycleXMLExpiration struct {
+	Days int `xml:"Days"`
+}
+
+type lifecycleXMLTransition struct {
+	Days         int    `xml:"Days"`
+	StorageClass string `xml:"StorageClass,omitempty"`
+}
+
+type lifecycleXMLAbortUpload struct {
+	DaysAfterInitiation int `xml:"DaysAfterInitiation"`
+}
+
+// SetLifecycle applies cfg as the bucket's lifecycle policy via a single Rule combining
+// whichever of Expiration, Transition, and AbortIncompleteMultipartUpload are enabled,
+// satisfying objectstore.Lifecycle.
+func (s *MinIOStore) SetLifecycle(ctx context.Context, bucket string, cfg LifecycleConfig) error {
+	rule := lifecycleXMLRule{ID: lifecycleRuleID, Status: "Enabled"}
+
+	if cfg.ExpireDays > 0 {
+		rule.Expiration = &lifecycleXMLExpiration{Days: cfg.ExpireDays}
+	}
+	if cfg.TransitionDays > 0 {
+		rule.Transition = &lifecycleXMLTransition{Days: cfg.TransitionDays, StorageClass: cfg.TransitionStorageClass}
+	}
+	if cfg.AbortMultipartDays > 0 {
+		rule.AbortIncompleteMultipartUpload = &lifecycleXMLAbortUpload{DaysAfterInitiation: cfg.AbortMultipartDays}
+	}
+
+	bs, err := xml.Marshal(lifecycleXML{Rules: []lifecycleXMLRule{rule}})
+	if err != nil {
+		return fmt.Errorf("unable to marshal lifecycle configuration: %+v", err)
+	}
+
+	return s.mc.SetBucketLifecycle(bucket, string(bs))
+}
+
+// GetLifecycle returns bucket's current lifecycle policy as applied by SetLifecycle,
+// satisfying objectstore.Lifecycle.
+func (s *MinIOStore) GetLifecycle(ctx context.Context, bucket string) (LifecycleConfig, error) {
+	raw, err := s.mc.GetBucketLifecycle(bucket)
+	if err != nil {
+		return LifecycleConfig{}, err
+	}
+
+	var parsed lifecycleXML
+	if err := xml.Unmarshal([]byte(raw), &parsed); err != nil {
+		return LifecycleConfig{}, fmt.Errorf("unable to parse lifecycle configuration: %+v", err)
+	}
+
+	for _, rule := range parsed.Rules {
+		if rule.ID != lifecycleRuleID {
+			continue
+		}
+
+		cfg := LifecycleConfig{}
+		if rule.Expiration != nil {
+			cfg.ExpireDays = rule.Expiration.Days
+		}
+		if rule.Transition != nil {
+			cfg.TransitionDays = rule.Transition.Days
+			cfg.TransitionStorageClass = rule.Transition.StorageClass
+		}
+		if rule.AbortIncompleteMultipartUpload != nil {
+			cfg.AbortMultipartDays = rule.AbortIncompleteMultipartUpload.DaysAfterInitiation
+		}
+
+		return cfg, nil
+	}
+
+	return LifecycleConfig{}, nil
+}
+
+// serverSide translates an SSEConfig into the encrypt.ServerSide minio-go
+// expects, returning nil in SSENone mode so callers can pass it straight to
+// the unencrypted code path.
+func serverSide(cfg SSEConfig) (encrypt.ServerSide, error) {
+	switch cfg.Mode {
+	case SSENone:
+		return nil, nil
+	case SSES3:
+		return encrypt.NewSSE(), nil
+	case SSEC:
+		return encrypt.NewSSEC(cfg.CustomerKey)
+	case SSEKMS:
+		return encrypt.NewSSEKMS(cfg.KMSKeyID, nil)
+	default:
+		return nil, fmt.Errorf("unsupported SSE mode %q", cfg.Mode)
+	}
+}
+
+// PutEncrypted writes r to bucket/key under sse, satisfying
+// objectstore.ServerSideEncryption.
+func (s *MinIOStore) PutEncrypted(ctx context.Context, bucket, key string, r io.Reader, contentType string, metadata map[string]string, sse SSEConfig) error {
+	sc, err := serverSide(sse)
+	if err != nil {
+		return err
+	}
+
+	if sc == nil {
+		return s.Put(ctx, bucket, key, r, contentType, metadata)
+	}
+
+	usermeta := make(map[string][]string, len(metadata)+1)
+	for k, v := range metadata {
+		usermeta[k] = []string{v}
+	}
+	usermeta["Content-Type"] = []string{contentType}
+
+	_, err = s.mc.PutObjectWithMetadata(bucket, key, r, usermeta, nil, sc)
+	return err
+}
+
+// GetEncrypted returns a reader over bucket/key, decrypting it with sse,
+// satisfying objectstore.ServerSideEncryption.
+func (s *MinIOStore) GetEncrypted(ctx context.Context, bucket, key string, sse SSEConfig) (io.ReadCloser, error) {
+	sc, err := serverSide(sse)
+	if err != nil {
+		return nil, err
+	}
+
+	if sc == nil {
+		return s.Get(ctx, bucket, key)
+	}
+
+	return s.mc.GetEncryptedObject(bucket, key, sc)
+}
+
+// RotateKey re-encrypts bucket/key in place under newSSE via a server-side
+// CopyObject, satisfying objectstore.ServerSideEncryption.
+func (s *MinIOStore) RotateKey(ctx context.Context, bucket, key string, oldSSE, newSSE SSEConfig) error {
+	oldSC, err := serverSide(oldSSE)
+	if err != nil {
+		return err
+	}
+
+	newSC, err := serverSide(newSSE)
+	if err != nil {
+		return err
+	}
+
+	src := minio.NewSourceInfo(bucket, key, oldSC)
+
+	dst, err := minio.NewDestinationInfo(bucket, key, newSC, nil)
+	if err != nil {
+		return err
+	}
+
+	return s.mc.CopyObject(dst, src)
+}
+
+func objectInfo(info minio.ObjectInfo) ObjectInfo {
+	metadata := make(map[string]string, len(info.Metadata))
+	for k := range info.Metadata {
+		metadata[k] = info.Metadata.Get(k)
+	}
+
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		LastModified: info.LastModified,
+		ContentType:  info.ContentType,
+		Metadata:     metadata,
+	}
+}
@@ -0,0 +1,84 @@
+// Package objectstore abstracts the object storage used by the fileup
+// microservices so that the local (receive/recognize/label/purge) bucket and
+// the archive destination bucket can each be backed by MinIO/S3, Google
+// Cloud Storage, Azure Blob Storage, or Backblaze B2, in any combination.
+//
+// Uploader, Archiver, Recognizer, and every other service in the pipeline hold a Store, not a
+// concrete *minio.Client/*storage.Client/etc; New picks the concrete implementation from
+// Config.Kind at construction time. pkg/blob builds on top of this package rather than beside
+// it: blob.Open translates a URL into a Config and calls New, and blob.MemStore is a Store
+// implementation that gives Uploader/Archiver/Recognizer a fake to unit test against.
+package objectstore
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// ObjectInfo describes an object held by a Store, as reported by Stat and
+// List.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ContentType  string
+	Metadata     map[string]string
+}
+
+// PresignMethod selects the HTTP method a Presign'd URL is valid for.
+type PresignMethod string
+
+// Methods accepted by Presign.
+const (
+	PresignGet PresignMethod = "GET"
+	PresignPut PresignMethod = "PUT"
+)
+
+// A Store is an object storage backend capable of the small set of
+// operations the fileup pipeline needs: writing received uploads, reading
+// them back for recognition/labeling/archiving, listing and removing them
+// during purge, copying them to an archive bucket, and minting presigned
+// URLs for direct client upload/download.
+type Store interface {
+	// Put writes the contents of r to bucket/key, tagging the object with
+	// contentType and the given user metadata.
+	Put(ctx context.Context, bucket, key string, r io.Reader, contentType string, metadata map[string]string) error
+
+	// Get returns a reader over the contents of bucket/key. Callers must
+	// Close the returned reader.
+	Get(ctx context.Context, bucket, key string) (io.ReadCloser, error)
+
+	// Stat returns the metadata for bucket/key without fetching its
+	// contents.
+	Stat(ctx context.Context, bucket, key string) (ObjectInfo, error)
+
+	// List returns the objects in bucket whose keys start with prefix.
+	List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error)
+
+	// Remove deletes bucket/key.
+	Remove(ctx context.Context, bucket, key string) error
+
+	// Copy copies srcBucket/srcKey to dstBucket/dstKey, both in this Store.
+	// Copying between two different Stores takes a Get on one and a Put on
+	// the other.
+	Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string) error
+
+	// Presign returns a URL that grants time-limited access to bucket/key
+	// for the given method without further authentication, valid for
+	// expiry.
+	Presign(ctx context.Context, bucket, key string, method PresignMethod, expiry time.Duration) (string, error)
+}
+
+// A BucketLifecycle is implemented by Store backends whose buckets must be
+// explicitly created and destroyed by the application (MinIO/S3), as
+// opposed to backends where buckets are provisioned out of band (GCS,
+// Azure, B2). Callers that need to manage bucket lifecycle should type-
+// assert a Store for this interface rather than assuming it's present.
+type BucketLifecycle interface {
+	// EnsureBucket creates bucket if it does not already exist.
+	EnsureBucket(ctx context.Context, bucket string) error
+
+	// RemoveBucket deletes bucket, which must be empty.
+	RemoveBucket(ctx context.Context, bucket string) error
+}
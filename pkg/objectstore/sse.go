@@ -0,0 +1,67 @@
+package objectstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+)
+
+// SSEMode selects the flavor of server-side encryption applied to an object,
+// independent of the pkg/crypto envelope encryption layered on top of it.
+type SSEMode string
+
+// Server-side encryption modes accepted by --sse-mode on the receiver and
+// uploader binaries.
+const (
+	SSENone SSEMode = ""
+	SSES3   SSEMode = "sse-s3"
+	SSEC    SSEMode = "sse-c"
+	SSEKMS  SSEMode = "sse-kms"
+)
+
+// SSEConfig describes the server-side encryption a caller wants Put/Copy to
+// apply. KMSKeyID is used in SSEKMS mode; CustomerKey (a 32-byte AES-256 key)
+// is used in SSEC mode. Neither field is meaningful in SSENone or SSES3 mode.
+type SSEConfig struct {
+	Mode        SSEMode
+	KMSKeyID    string
+	CustomerKey []byte
+}
+
+// KeyID returns the non-secret identifier for cfg that's safe to carry
+// alongside an object in a PubSub message or object metadata: the KMS key
+// resource name in SSEKMS mode, or a SHA-256 fingerprint of the customer key
+// in SSEC mode. It never returns key material.
+func (cfg SSEConfig) KeyID() string {
+	switch cfg.Mode {
+	case SSEKMS:
+		return cfg.KMSKeyID
+	case SSEC:
+		sum := sha256.Sum256(cfg.CustomerKey)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return ""
+	}
+}
+
+// ServerSideEncryption is implemented by Store backends that can apply
+// object-store-managed encryption (SSE-S3/SSE-C/SSE-KMS) to an object, as
+// distinct from the application-level envelope encryption pkg/crypto
+// provides. Callers that need server-side encryption should type-assert a
+// Store for this interface rather than assuming it's present.
+type ServerSideEncryption interface {
+	// PutEncrypted writes the contents of r to bucket/key exactly like Put,
+	// additionally applying sse.
+	PutEncrypted(ctx context.Context, bucket, key string, r io.Reader, contentType string, metadata map[string]string, sse SSEConfig) error
+
+	// GetEncrypted returns a reader over bucket/key exactly like Get,
+	// supplying the customer key or KMS key sse describes so the backend can
+	// decrypt the object. Callers must Close the returned reader.
+	GetEncrypted(ctx context.Context, bucket, key string, sse SSEConfig) (io.ReadCloser, error)
+
+	// RotateKey re-encrypts bucket/key in place under newSSE, replacing
+	// whatever server-side encryption (if any) currently protects it.
+	// oldSSE must describe the encryption the object currently has, if any.
+	RotateKey(ctx context.Context, bucket, key string, oldSSE, newSSE SSEConfig) error
+}
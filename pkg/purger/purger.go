@@ -0,0 +1,67 @@
+// Package purger provides the constructor and ReceiveAndProcess method for the purger microservice.
+// The purger microservice is responsible for removing images from the local object store
+// once the rest of the pipeline is done with them.
+package purger
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/wkharold/fileup/pkg/bus"
+	"github.com/wkharold/fileup/pkg/events"
+	"github.com/wkharold/fileup/pkg/objectstore"
+	"github.com/wkharold/fileup/pkg/sdlog"
+)
+
+// A Purger removes images from the local object store in response to purge
+// events it receives via its message bus subscription.
+type Purger struct {
+	logger *sdlog.StackdriverLogger
+	store  objectstore.Store
+	bus    bus.Subscriber
+	pt     string
+	sid    string
+}
+
+// New creates and initializes a Purger. The purger subscribes to purgeTopic via b, so the
+// pipeline can run against any bus.Bus backend (Google PubSub, MQTT, ...).
+func New(logger *sdlog.StackdriverLogger, store objectstore.Store, projectID string, b bus.Subscriber, purgeTopic string) (*Purger, error) {
+	return &Purger{
+		logger: logger,
+		store:  store,
+		bus:    b,
+		pt:     purgeTopic,
+		sid:    fmt.Sprintf("%s%%%s", projectID, purgeTopic),
+	}, nil
+}
+
+// ReceiveAndProcess responds to image.purge events by removing the referenced
+// object from the local object store.
+func (p Purger) ReceiveAndProcess(ctx context.Context) {
+	err := p.bus.Subscribe(ctx, p.pt, p.sid, func(ctx context.Context, m bus.Message) {
+		defer m.Ack()
+
+		ev, err := events.Parse(m)
+		if err != nil {
+			p.logger.LogError("Bad message", err)
+			return
+		}
+		events.Log(p.logger, ev)
+
+		var img events.ImageData
+		if err := events.DataAs(ev, &img); err != nil {
+			p.logger.LogError(fmt.Sprintf("Unable to decode event %s", ev.ID()), err)
+			return
+		}
+
+		if err := p.store.Remove(ctx, img.Bucket, img.Object); err != nil {
+			p.logger.LogError(fmt.Sprintf("Could not remove local image %s/%s", img.Bucket, img.Object), err)
+			return
+		}
+
+		p.logger.LogInfo(fmt.Sprintf("Removed local image %s/%s", img.Bucket, img.Object))
+	})
+	if err != context.Canceled {
+		p.logger.LogError(fmt.Sprintf("Unable to receive from %s", p.sid), err)
+	}
+}
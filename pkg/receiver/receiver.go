@@ -1,9 +1,9 @@
 // Package receiver provides the constructor and ServeHTTP method for the receiver microservice.
 // The receiver microservice is responsible for accepting image files from clients, saving them in
-// local (minio) object storage, and publishing an image receive message to its Google PubSub
+// local object storage, and publishing an image receive message to its message bus
 // topic.
 //
-// Each receiver instance of the receiver microservice creates its own local (minio) object storage
+// Each receiver instance of the receiver microservice creates its own local object storage
 // bucket. Old object are removed from the bucket every five minutes and the bucket is removed when
 // the instance terminates.
 package receiver
@@ -11,18 +11,16 @@ package receiver
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"time"
 
-	"cloud.google.com/go/pubsub"
-	minio "github.com/minio/minio-go"
-	"github.com/wkharold/fileup/pkg/satokensource"
+	"github.com/wkharold/fileup/pkg/bus"
+	"github.com/wkharold/fileup/pkg/crypto"
+	"github.com/wkharold/fileup/pkg/events"
+	"github.com/wkharold/fileup/pkg/objectstore"
 	"github.com/wkharold/fileup/pkg/sdlog"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	iam "google.golang.org/api/iam/v1"
-	"google.golang.org/api/option"
 )
 
 // A Receiver accepts image upload requests via HTTP. The images it
@@ -30,14 +28,19 @@ import (
 // by other services. A message is published on the receivers topic for
 // every image received.
 type Receiver struct {
-	bucket string
-	logger *sdlog.StackdriverLogger
-	mc     *minio.Client
-	topic  *pubsub.Topic
+	bucket    string
+	logger    *sdlog.StackdriverLogger
+	store     objectstore.Store
+	enc       *crypto.Encryptor
+	sse       objectstore.SSEConfig
+	bus       bus.Publisher
+	topic     string
+	projectID string
 }
 
 const (
 	noprefix = ""
+	source   = "fileup/receiver"
 )
 
 var (
@@ -45,22 +48,20 @@ var (
 )
 
 // purgeOldObjects deletes objects from the local store that are older than five minutes.
-func purgeOldObjects(mc *minio.Client, logger *sdlog.StackdriverLogger, bucket string) {
-	done := make(chan struct{})
-	defer close(done)
-
+func purgeOldObjects(store objectstore.Store, logger *sdlog.StackdriverLogger, bucket string) {
 	now := time.Now()
 
 	log.Printf("Purging old objects @ %+v", now)
 
-	for obj := range mc.ListObjectsV2(bucket, noprefix, true, done) {
-		if obj.Err != nil {
-			logger.LogError(fmt.Sprintf("Problem listing contents of bucket %s", bucket), obj.Err)
-			continue
-		}
+	objs, err := store.List(ctx, bucket, noprefix)
+	if err != nil {
+		logger.LogError(fmt.Sprintf("Problem listing contents of bucket %s", bucket), err)
+		return
+	}
 
+	for _, obj := range objs {
 		if now.Sub(obj.LastModified) > (time.Minute * 5) {
-			if err := mc.RemoveObject(bucket, obj.Key); err != nil {
+			if err := store.Remove(ctx, bucket, obj.Key); err != nil {
 				logger.LogError(fmt.Sprintf("Unable to remove %s/%s from local storage", bucket, obj.Key), err)
 			}
 			log.Printf("removed %s/%s", bucket, obj.Key)
@@ -69,60 +70,62 @@ func purgeOldObjects(mc *minio.Client, logger *sdlog.StackdriverLogger, bucket s
 }
 
 // New creates and initializes a Receiver. The receiver accepts image upload requests over HTTP and stores received
-// images in a local object store (minio). It uses the specified serviceAccount to publish image received notifications
-// to its pubsub topic.
-func New(mc *minio.Client, bucket string, logger *sdlog.StackdriverLogger, projectID, serviceAccount, topic string) (*Receiver, error) {
-	client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
-	if err != nil {
-		log.Fatalf("unable to get application default credentials: %+v\n", err)
-	}
-
+// images in a local object store. It publishes image received notifications to topic via b, so that the
+// pipeline can run against any bus.Bus backend (Google PubSub, MQTT, ...). Received images are envelope-encrypted
+// with enc before being written to the object store; enc may be a passthrough Encryptor if no KMS key is configured.
+// sse additionally requests object-store-managed server-side encryption (sse.Mode may be SSENone to disable it);
+// with any other mode, writes fail unless the store implements objectstore.ServerSideEncryption.
+// projectID is used to format the Cloud Trace trace name stamped on log entries and propagated
+// downstream with the published event.
+func New(store objectstore.Store, bucket string, logger *sdlog.StackdriverLogger, enc *crypto.Encryptor, sse objectstore.SSEConfig, b bus.Publisher, topic, projectID string) (*Receiver, error) {
 	receiver := &Receiver{
-		bucket: bucket,
-		logger: logger,
-		mc:     mc,
-	}
-
-	pc, err := pubsub.NewClient(ctx, projectID, option.WithTokenSource(oauth2.ReuseTokenSource(nil, satokensource.New(client, logger, projectID, serviceAccount))))
-	if err != nil {
-		logger.LogError(fmt.Sprintf("Unable to create PubSub client for project: %s", projectID), err)
-		return nil, err
-	}
-
-	receiver.topic = pc.Topic(topic)
-
-	ok, err := receiver.topic.Exists(ctx)
-	if err != nil {
-		logger.LogError(fmt.Sprintf("Unable to determine if pubsub topic %s exists", topic), err)
-		return nil, err
-	}
-
-	if !ok {
-		receiver.topic, err = pc.CreateTopic(ctx, topic)
-		if err != nil {
-			logger.LogError(fmt.Sprintf("Unable to create pubsub topic %s exists", topic), err)
-			return nil, err
-		}
+		bucket:    bucket,
+		logger:    logger,
+		store:     store,
+		enc:       enc,
+		sse:       sse,
+		bus:       b,
+		topic:     topic,
+		projectID: projectID,
 	}
 
 	go func() {
 		ticker := time.NewTicker(time.Minute * 5)
 		for _ = range ticker.C {
-			purgeOldObjects(mc, logger, bucket)
+			purgeOldObjects(store, logger, bucket)
 		}
 	}()
 
 	return receiver, nil
 }
 
-// ServeHTTP handles receiving the image file and writing it to the local (minio) object store.
+// put writes r's contents to object under r.bucket. With r.sse.Mode SSENone it does a plain
+// Put; with any other mode it applies r.sse, returning an error if the underlying store does
+// not support objectstore.ServerSideEncryption.
+func (r Receiver) put(object string, body io.Reader, meta map[string]string) error {
+	if r.sse.Mode == objectstore.SSENone {
+		return r.store.Put(ctx, r.bucket, object, body, "application/octet-stream", meta)
+	}
+
+	sse, ok := r.store.(objectstore.ServerSideEncryption)
+	if !ok {
+		return fmt.Errorf("object store does not support server-side encryption")
+	}
+
+	return sse.PutEncrypted(ctx, r.bucket, object, body, "application/octet-stream", meta, r.sse)
+}
+
+// ServeHTTP handles receiving the image file and writing it to the local object store.
 // Once the file is saved in the local object store a message is published to the image topic.
 func (r Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	trace, spanID := sdlog.ParseCloudTraceContext(r.projectID, req.Header.Get("X-Cloud-Trace-Context"), req.Header.Get("traceparent"))
+	logger := r.logger.WithTrace(trace, spanID)
+
 	file, header, err := req.FormFile("file")
 	if err != nil {
 		msg := fmt.Sprint("Unable to extract file contents from request")
 
-		r.logger.LogError(msg, err)
+		logger.LogError(msg, err)
 
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "%s [%+v]", msg, err)
@@ -130,40 +133,46 @@ func (r Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	defer file.Close()
 
-	n, err := r.mc.PutObject(r.bucket, header.Filename, file, "application/octet-stream")
+	logger = logger.WithFields(map[string]interface{}{"bucket": r.bucket, "object": header.Filename})
+
+	sealed, meta, err := r.enc.Seal(ctx, file)
 	if err != nil {
-		msg := fmt.Sprintf("File upload failed")
+		msg := fmt.Sprintf("Unable to encrypt %s", header.Filename)
 
-		r.logger.LogError(msg, err)
+		logger.LogError(msg, err)
 
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "%s [%+v]", msg, err)
 		return
 	}
-	if n != header.Size {
-		msg := fmt.Sprintf("File upload incomplete")
-		err = fmt.Errorf("wrote %d wanted %d", n, header.Size)
 
-		r.logger.LogError(msg, err)
+	if err = r.put(header.Filename, sealed, meta); err != nil {
+		msg := fmt.Sprintf("File upload failed")
+
+		logger.LogError(msg, err)
 
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "%s [%+v]", msg, err)
 		return
 	}
 
-	pr := r.topic.Publish(ctx, &pubsub.Message{Data: []byte(fmt.Sprintf("%s/%s", r.bucket, header.Filename))})
-	id, err := pr.Get(ctx)
+	id, err := events.PublishWithTrace(ctx, r.bus, r.topic, events.TypeImageReceived, source, events.ImageData{
+		Bucket:   r.bucket,
+		Object:   header.Filename,
+		Size:     header.Size,
+		SSEKeyID: r.sse.KeyID(),
+	}, trace, spanID)
 	if err != nil {
-		msg := fmt.Sprintf("Received notifcation failed for topic %s", r.topic.ID())
+		msg := fmt.Sprintf("Received notifcation failed for topic %s", r.topic)
 
-		r.logger.LogError(msg, err)
+		logger.LogError(msg, err)
 
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "%s [%+v]", msg, err)
 		return
 	}
 
-	r.logger.LogInfo(fmt.Sprintf("Published message id: %+v", id))
+	logger.Info("Published event", map[string]interface{}{"event_id": id})
 
 	fmt.Fprintf(w, "File %s uploaded successfully.\n", header.Filename)
 }
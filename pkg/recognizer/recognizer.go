@@ -1,160 +1,178 @@
+// Package recognizer provides the constructor and ReceiveAndProcess method for the recognizer
+// microservice. The recognizer microservice runs a configurable RuleSet of Vision API conditions
+// against every received image, publishing a recognized notification to each rule's topic for
+// every rule it matches, and a purge notification to the rule set's default topic if no rule
+// matches.
 package recognizer
 
 import (
 	"context"
 	"fmt"
-	"strings"
-	"time"
 
-	"cloud.google.com/go/pubsub"
 	vision "cloud.google.com/go/vision/apiv1"
-	minio "github.com/minio/minio-go"
+	"github.com/wkharold/fileup/pkg/bus"
+	"github.com/wkharold/fileup/pkg/crypto"
+	"github.com/wkharold/fileup/pkg/events"
+	"github.com/wkharold/fileup/pkg/objectstore"
 	"github.com/wkharold/fileup/pkg/satokensource"
 	"github.com/wkharold/fileup/pkg/sdlog"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	iam "google.golang.org/api/iam/v1"
-	"google.golang.org/api/option"
 	vpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
 )
 
 type Recognizer struct {
 	logger *sdlog.StackdriverLogger
 	iac    *vision.ImageAnnotatorClient
-	mc     *minio.Client
-	pc     *pubsub.Client
-	pt     string
-	rt     string
-	sub    *pubsub.Subscription
-	tl     string
+	store  objectstore.Store
+	enc    *crypto.Encryptor
+	sse    objectstore.SSEConfig
+	bus    bus.Bus
+	it     string
+	sid    string
+
+	rules        []compiledRule
+	features     []*vpb.Feature
+	defaultTopic string
 }
 
+const source = "fileup/recognizer"
+
 var (
 	ctx = context.Background()
 )
 
-func New(logger *sdlog.StackdriverLogger, mc *minio.Client, projectId, serviceAccount, imageTopic, purgeTopic, recognizedTopic, targetLabel string) (*Recognizer, error) {
-	client, err := google.DefaultClient(ctx, iam.CloudPlatformScope, "https://www.googleapis.com/auth/iam")
+// New creates and initializes a Recognizer that evaluates rules against every image received on
+// imageTopic. tsMode and tsKeyFile select how Vision API tokens are minted; see
+// satokensource.Config.
+func New(logger *sdlog.StackdriverLogger, store objectstore.Store, enc *crypto.Encryptor, sse objectstore.SSEConfig, projectId, serviceAccount string, b bus.Bus, imageTopic string, rules RuleSet, tsMode satokensource.Mode, tsKeyFile string) (*Recognizer, error) {
+	compiled, err := compile(rules)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid rule set: %+v", err)
 	}
 
 	recognizer := &Recognizer{
-		logger: logger,
-		mc:     mc,
-		pt:     purgeTopic,
-		rt:     recognizedTopic,
-		tl:     targetLabel,
-	}
-
-	ts := option.WithTokenSource(oauth2.ReuseTokenSource(nil, satokensource.New(client, logger, projectId, serviceAccount)))
-
-	recognizer.iac, err = vision.NewImageAnnotatorClient(ctx, ts)
-	if err != nil {
-		return nil, err
+		logger:       logger,
+		store:        store,
+		enc:          enc,
+		sse:          sse,
+		bus:          b,
+		it:           imageTopic,
+		sid:          fmt.Sprintf("%s%%%s", projectId, imageTopic),
+		rules:        compiled,
+		features:     features(compiled),
+		defaultTopic: rules.DefaultTopic,
 	}
 
-	recognizer.pc, err = pubsub.NewClient(ctx, projectId, ts)
+	ts, err := satokensource.TokenSourceOption(ctx, satokensource.Config{
+		Mode:           tsMode,
+		Logger:         logger,
+		ProjectID:      projectId,
+		ServiceAccount: serviceAccount,
+		KeyFile:        tsKeyFile,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	sid := fmt.Sprintf("%s%%%s", projectId, imageTopic)
-
-	recognizer.sub = recognizer.pc.Subscription(sid)
-
-	ok, err := recognizer.sub.Exists(ctx)
+	recognizer.iac, err = vision.NewImageAnnotatorClient(ctx, ts)
 	if err != nil {
 		return nil, err
 	}
 
-	if !ok {
-		recognizer.sub, err = recognizer.pc.CreateSubscription(ctx, sid, pubsub.SubscriptionConfig{
-			Topic:       recognizer.pc.Topic(imageTopic),
-			AckDeadline: 60 * time.Second,
-		})
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	return recognizer, nil
 }
 
 func (r Recognizer) ReceiveAndProcess(ctx context.Context) {
-	err := r.sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+	err := r.bus.Subscribe(ctx, r.it, r.sid, func(ctx context.Context, m bus.Message) {
 		defer m.Ack()
 
-		mparts := strings.Split(string(m.Data), "/")
-		if len(mparts) != 2 {
-			r.logger.LogError("Bad message", fmt.Errorf("Message must have format <bucket/image> [%s]", string(m.Data)))
+		ev, err := events.Parse(m)
+		if err != nil {
+			r.logger.LogError("Bad message", err)
+			return
+		}
+
+		trace, spanID := events.Trace(ev)
+		logger := r.logger.WithTrace(trace, spanID)
+		events.Log(logger, ev)
+
+		var img events.ImageData
+		if err := events.DataAs(ev, &img); err != nil {
+			logger.LogError(fmt.Sprintf("Unable to decode event %s", ev.ID()), err)
 			return
 		}
+		logger = logger.WithFields(map[string]interface{}{"bucket": img.Bucket, "object": img.Object})
 
-		ok, err := r.isRecognized(mparts[0], mparts[1], r.tl)
+		res, err := r.annotate(img.Bucket, img.Object)
 		if err != nil {
-			r.logger.LogError(fmt.Sprintf("Unable to recognize %s", string(m.Data)), err)
+			logger.LogError(fmt.Sprintf("Unable to annotate %s/%s", img.Bucket, img.Object), err)
 			return
 		}
 
-		if !ok {
-			if err = sendNotification(r.pc, r.logger, r.pt, string(m.Data)); err != nil {
-				r.logger.LogError("Unable to send notification", err)
+		fired := 0
+		for _, rule := range r.rules {
+			if !rule.matches(res) {
+				continue
+			}
+			fired++
+
+			logger.Info(fmt.Sprintf("rule %s matched %s/%s", rule.Name, img.Bucket, img.Object), map[string]interface{}{"rule": rule.Name, "topic": rule.Topic})
+
+			if _, err := sendNotification(r.bus, logger, rule.Topic, events.TypeImageRecognized, rule.Name, img, trace, spanID); err != nil {
+				logger.LogError("Unable to send notification", err)
 			}
-			return
 		}
 
-		if err = sendNotification(r.pc, r.logger, r.rt, string(m.Data)); err != nil {
-			r.logger.LogError("Unable to send notification", err)
+		if fired == 0 && r.defaultTopic != "" {
+			logger.Info(fmt.Sprintf("no rule matched %s/%s, using default topic", img.Bucket, img.Object), map[string]interface{}{"topic": r.defaultTopic})
+
+			if _, err := sendNotification(r.bus, logger, r.defaultTopic, events.TypeImagePurge, "", img, trace, spanID); err != nil {
+				logger.LogError("Unable to send notification", err)
+			}
 		}
 	})
 	if err != context.Canceled {
-		r.logger.LogError(fmt.Sprintf("Unable to receive from %s", r.sub.ID()), err)
+		r.logger.LogError(fmt.Sprintf("Unable to receive from %s", r.sid), err)
 	}
 }
 
-func (r Recognizer) isRecognized(bucket, image, label string) (bool, error) {
-	obj, err := r.mc.GetObject(bucket, image)
+// annotate fetches bucket/object and runs a single AnnotateImage call requesting the union of
+// features every configured rule needs.
+func (r Recognizer) annotate(bucket, object string) (*vpb.AnnotateImageResponse, error) {
+	obj, err := r.enc.GetObjectSSE(r.store, r.sse, bucket, object)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	img, err := vision.NewImageFromReader(obj)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	res, err := r.iac.AnnotateImage(ctx, &vpb.AnnotateImageRequest{
-		Image: img,
-		Features: []*vpb.Feature{
-			{Type: vpb.Feature_LABEL_DETECTION, MaxResults: 3},
-		},
+	return r.iac.AnnotateImage(ctx, &vpb.AnnotateImageRequest{
+		Image:    img,
+		Features: r.features,
 	})
-	if err != nil {
-		return false, err
-	}
-
-	for _, ea := range res.LabelAnnotations {
-		if strings.Contains(ea.Description, label) {
-			return true, nil
-		}
-	}
-
-	return false, nil
 }
 
-func sendNotification(pc *pubsub.Client, logger *sdlog.StackdriverLogger, topic, location string) error {
-	t := pc.Topic(topic)
-
-	msg := &pubsub.Message{Data: []byte(location)}
-
-	pr := t.Publish(ctx, msg)
-	id, err := pr.Get(ctx)
+// sendNotification publishes an image event of eventType for img to topic, attaching ruleName
+// as a "rule" message attribute if non-empty so subscribers can filter on which rule fired
+// without decoding the envelope.
+func sendNotification(pub bus.Publisher, logger *sdlog.StackdriverLogger, topic, eventType, ruleName string, img events.ImageData, trace, spanID string) (string, error) {
+	var (
+		id  string
+		err error
+	)
+
+	if ruleName != "" {
+		id, err = events.PublishWithAttributes(ctx, pub, topic, eventType, source, img, trace, spanID, map[string]string{"rule": ruleName})
+	} else {
+		id, err = events.PublishWithTrace(ctx, pub, topic, eventType, source, img, trace, spanID)
+	}
 	if err != nil {
-		return fmt.Errorf("Unable publish to send notification to topic %s [%+v]", topic, err)
+		return "", fmt.Errorf("unable to publish notification to topic %s [%+v]", topic, err)
 	}
 
-	logger.LogInfo(fmt.Sprintf("published message %s to topic %s [%s]", id, topic, string(msg.Data)))
+	logger.LogInfo(fmt.Sprintf("published event %s to topic %s [%s/%s]", id, topic, img.Bucket, img.Object))
 
-	return nil
+	return id, nil
 }
@@ -0,0 +1,257 @@
+package recognizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	vpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// Feature names a Vision API annotation type a Rule can request, using the same names as the
+// Vision API's own Feature.Type enum so a RuleSet file reads like the Vision API documentation.
+type Feature string
+
+// Features a Rule's Features list may contain.
+const (
+	FeatureLabel      Feature = "LABEL_DETECTION"
+	FeatureSafeSearch Feature = "SAFE_SEARCH_DETECTION"
+	FeatureFace       Feature = "FACE_DETECTION"
+	FeatureObject     Feature = "OBJECT_LOCALIZATION"
+	FeatureText       Feature = "TEXT_DETECTION"
+)
+
+// proto returns the vpb.Feature_Type f requests, or Feature_TYPE_UNSPECIFIED for an unrecognized
+// name (skipped by features rather than sent to the Vision API).
+func (f Feature) proto() vpb.Feature_Type {
+	switch f {
+	case FeatureLabel:
+		return vpb.Feature_LABEL_DETECTION
+	case FeatureSafeSearch:
+		return vpb.Feature_SAFE_SEARCH_DETECTION
+	case FeatureFace:
+		return vpb.Feature_FACE_DETECTION
+	case FeatureObject:
+		return vpb.Feature_OBJECT_LOCALIZATION
+	case FeatureText:
+		return vpb.Feature_TEXT_DETECTION
+	default:
+		return vpb.Feature_TYPE_UNSPECIFIED
+	}
+}
+
+// likelihoods maps the names a Match's MinAdultLikelihood/MinViolenceLikelihood accept to the
+// vpb.Likelihood values they compare against, in the order Vision API assigns them (least to
+// most likely).
+var likelihoods = map[string]vpb.Likelihood{
+	"UNKNOWN":       vpb.Likelihood_UNKNOWN,
+	"VERY_UNLIKELY": vpb.Likelihood_VERY_UNLIKELY,
+	"UNLIKELY":      vpb.Likelihood_UNLIKELY,
+	"POSSIBLE":      vpb.Likelihood_POSSIBLE,
+	"LIKELY":        vpb.Likelihood_LIKELY,
+	"VERY_LIKELY":   vpb.Likelihood_VERY_LIKELY,
+}
+
+// Match describes the condition a Rule evaluates against a Vision AnnotateImageResponse. Every
+// field is optional; a Match with no fields set matches every image, which is useful for a
+// catch-all Rule. A Match with several fields set requires all of them to hold.
+type Match struct {
+	// LabelPattern is a case-insensitive regular expression matched against the description of
+	// every label and localized object annotation; MinLabelScore additionally requires the
+	// matching annotation's score to be at least this high.
+	LabelPattern  string  `json:"labelPattern,omitempty"`
+	MinLabelScore float32 `json:"minLabelScore,omitempty"`
+
+	// MinAdultLikelihood and MinViolenceLikelihood require the SafeSearchAnnotation's
+	// Adult/Violence likelihood to be at least this high (one of the keys of the likelihoods
+	// map, e.g. "LIKELY"). Requires FeatureSafeSearch.
+	MinAdultLikelihood    string `json:"minAdultLikelihood,omitempty"`
+	MinViolenceLikelihood string `json:"minViolenceLikelihood,omitempty"`
+
+	// MinFaces requires at least this many FaceAnnotations. Requires FeatureFace.
+	MinFaces int `json:"minFaces,omitempty"`
+
+	// MinObjects requires at least this many LocalizedObjectAnnotations. Requires FeatureObject.
+	MinObjects int `json:"minObjects,omitempty"`
+
+	// TextPattern is a case-insensitive regular expression matched against every detected text
+	// annotation. Requires FeatureText.
+	TextPattern string `json:"textPattern,omitempty"`
+}
+
+// Rule pairs a Match condition with the topic matching images are published to. Name is
+// attached to the published event as a message attribute and logged, so operators can see which
+// rules fired and tune their thresholds.
+type Rule struct {
+	Name     string    `json:"name"`
+	Features []Feature `json:"features"`
+	Match    Match     `json:"match"`
+	Topic    string    `json:"topic"`
+}
+
+// RuleSet is the configuration ReceiveAndProcess evaluates for every image: each Rule it matches
+// is published to its own Topic, and DefaultTopic (if set) receives images that match no Rule.
+type RuleSet struct {
+	Rules        []Rule `json:"rules"`
+	DefaultTopic string `json:"defaultTopic"`
+}
+
+// LoadRuleSet reads and parses the JSON-encoded RuleSet at path.
+func LoadRuleSet(path string) (RuleSet, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return RuleSet{}, fmt.Errorf("unable to read rule set %s: %+v", path, err)
+	}
+
+	var rs RuleSet
+	if err := json.Unmarshal(bs, &rs); err != nil {
+		return RuleSet{}, fmt.Errorf("unable to parse rule set %s: %+v", path, err)
+	}
+
+	return rs, nil
+}
+
+// compiledRule is a Rule with its regular expressions pre-compiled, so ReceiveAndProcess never
+// compiles one per message.
+type compiledRule struct {
+	Rule
+	labelRe *regexp.Regexp
+	textRe  *regexp.Regexp
+}
+
+// compile validates rs and pre-compiles its rules' patterns, returning an error that names the
+// offending rule if a name/topic is missing or a pattern fails to compile.
+func compile(rs RuleSet) ([]compiledRule, error) {
+	compiled := make([]compiledRule, 0, len(rs.Rules))
+
+	for _, r := range rs.Rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule set has a rule with no name")
+		}
+		if r.Topic == "" {
+			return nil, fmt.Errorf("rule %s has no topic", r.Name)
+		}
+
+		cr := compiledRule{Rule: r}
+
+		if r.Match.LabelPattern != "" {
+			re, err := regexp.Compile("(?i)" + r.Match.LabelPattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: invalid labelPattern: %+v", r.Name, err)
+			}
+			cr.labelRe = re
+		}
+
+		if r.Match.TextPattern != "" {
+			re, err := regexp.Compile("(?i)" + r.Match.TextPattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: invalid textPattern: %+v", r.Name, err)
+			}
+			cr.textRe = re
+		}
+
+		compiled = append(compiled, cr)
+	}
+
+	return compiled, nil
+}
+
+// features returns the union, as Vision API feature requests, of every compiled rule's
+// Features, so ReceiveAndProcess can make a single AnnotateImage call that satisfies every rule.
+func features(rules []compiledRule) []*vpb.Feature {
+	seen := map[vpb.Feature_Type]bool{}
+	feats := []*vpb.Feature{}
+
+	for _, r := range rules {
+		for _, f := range r.Features {
+			pf := f.proto()
+			if pf == vpb.Feature_TYPE_UNSPECIFIED || seen[pf] {
+				continue
+			}
+
+			seen[pf] = true
+			feats = append(feats, &vpb.Feature{Type: pf})
+		}
+	}
+
+	return feats
+}
+
+// annotation is the description/score pair matches compares LabelPattern/MinLabelScore against,
+// gathered from both label and localized object annotations.
+type annotation struct {
+	description string
+	score       float32
+}
+
+func annotations(res *vpb.AnnotateImageResponse) []annotation {
+	anns := make([]annotation, 0, len(res.LabelAnnotations)+len(res.LocalizedObjectAnnotations))
+
+	for _, ea := range res.LabelAnnotations {
+		anns = append(anns, annotation{description: ea.Description, score: ea.Score})
+	}
+	for _, oa := range res.LocalizedObjectAnnotations {
+		anns = append(anns, annotation{description: oa.Name, score: oa.Score})
+	}
+
+	return anns
+}
+
+// matches reports whether res satisfies every condition cr.Match sets.
+func (cr compiledRule) matches(res *vpb.AnnotateImageResponse) bool {
+	m := cr.Match
+
+	if cr.labelRe != nil {
+		found := false
+		for _, a := range annotations(res) {
+			if a.score < m.MinLabelScore {
+				continue
+			}
+			if cr.labelRe.MatchString(a.description) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if m.MinAdultLikelihood != "" {
+		threshold, ok := likelihoods[m.MinAdultLikelihood]
+		if !ok || res.SafeSearchAnnotation == nil || res.SafeSearchAnnotation.Adult < threshold {
+			return false
+		}
+	}
+
+	if m.MinViolenceLikelihood != "" {
+		threshold, ok := likelihoods[m.MinViolenceLikelihood]
+		if !ok || res.SafeSearchAnnotation == nil || res.SafeSearchAnnotation.Violence < threshold {
+			return false
+		}
+	}
+
+	if m.MinFaces > 0 && len(res.FaceAnnotations) < m.MinFaces {
+		return false
+	}
+
+	if m.MinObjects > 0 && len(res.LocalizedObjectAnnotations) < m.MinObjects {
+		return false
+	}
+
+	if cr.textRe != nil {
+		found := false
+		for _, ta := range res.TextAnnotations {
+			if cr.textRe.MatchString(ta.Description) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,107 @@
+package recognizer
+
+import (
+	"testing"
+
+	vpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+func TestCompileRejectsRulesMissingNameOrTopicOrWithBadPattern(t *testing.T) {
+	cases := []RuleSet{
+		{Rules: []Rule{{Topic: "t"}}},
+		{Rules: []Rule{{Name: "n"}}},
+		{Rules: []Rule{{Name: "n", Topic: "t", Match: Match{LabelPattern: "("}}}},
+	}
+
+	for i, rs := range cases {
+		if _, err := compile(rs); err == nil {
+			t.Fatalf("case %d: expected an error, got nil", i)
+		}
+	}
+}
+
+func TestRuleMatchesOnLabelPatternAndScore(t *testing.T) {
+	rs := RuleSet{Rules: []Rule{{
+		Name:     "cats",
+		Features: []Feature{FeatureLabel},
+		Match:    Match{LabelPattern: "cat", MinLabelScore: 0.8},
+		Topic:    "cats",
+	}}}
+
+	compiled, err := compile(rs)
+	if err != nil {
+		t.Fatalf("compile() returned an error: %+v", err)
+	}
+
+	res := &vpb.AnnotateImageResponse{
+		LabelAnnotations: []*vpb.EntityAnnotation{
+			{Description: "dog", Score: 0.99},
+			{Description: "Cat", Score: 0.5},
+		},
+	}
+
+	if compiled[0].matches(res) {
+		t.Fatal("expected no match: the only Cat annotation scores below MinLabelScore")
+	}
+
+	res.LabelAnnotations[1].Score = 0.9
+	if !compiled[0].matches(res) {
+		t.Fatal("expected a match once the Cat annotation clears MinLabelScore")
+	}
+}
+
+func TestRuleMatchesRequiresEveryConditionInMatch(t *testing.T) {
+	rs := RuleSet{Rules: []Rule{{
+		Name:     "violent-cats",
+		Features: []Feature{FeatureLabel, FeatureSafeSearch},
+		Match:    Match{LabelPattern: "cat", MinViolenceLikelihood: "LIKELY"},
+		Topic:    "flagged",
+	}}}
+
+	compiled, err := compile(rs)
+	if err != nil {
+		t.Fatalf("compile() returned an error: %+v", err)
+	}
+
+	res := &vpb.AnnotateImageResponse{
+		LabelAnnotations:     []*vpb.EntityAnnotation{{Description: "cat", Score: 1}},
+		SafeSearchAnnotation: &vpb.SafeSearchAnnotation{Violence: vpb.Likelihood_POSSIBLE},
+	}
+
+	if compiled[0].matches(res) {
+		t.Fatal("expected no match: violence likelihood is below the rule's threshold")
+	}
+
+	res.SafeSearchAnnotation.Violence = vpb.Likelihood_VERY_LIKELY
+	if !compiled[0].matches(res) {
+		t.Fatal("expected a match once every condition in Match holds")
+	}
+}
+
+func TestRuleWithNoMatchFieldsMatchesEverything(t *testing.T) {
+	rs := RuleSet{Rules: []Rule{{Name: "catch-all", Topic: "default"}}}
+
+	compiled, err := compile(rs)
+	if err != nil {
+		t.Fatalf("compile() returned an error: %+v", err)
+	}
+
+	if !compiled[0].matches(&vpb.AnnotateImageResponse{}) {
+		t.Fatal("expected a Rule with no Match fields set to match an empty response")
+	}
+}
+
+func TestFeaturesDedupesAcrossRules(t *testing.T) {
+	compiled, err := compile(RuleSet{Rules: []Rule{
+		{Name: "a", Topic: "ta", Features: []Feature{FeatureLabel, FeatureFace}},
+		{Name: "b", Topic: "tb", Features: []Feature{FeatureLabel, FeatureSafeSearch}},
+	}})
+	if err != nil {
+		t.Fatalf("compile() returned an error: %+v", err)
+	}
+
+	feats := features(compiled)
+	if len(feats) != 3 {
+		t.Fatalf("expected the 3 distinct feature types across both rules, got %d: %+v", len(feats), feats)
+	}
+}
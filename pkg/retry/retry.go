@@ -0,0 +1,63 @@
+// Package retry provides a small exponential backoff helper for operations, such as a Pub/Sub
+// publish, that can fail transiently and are worth retrying before giving up.
+package retry
+
+import (
+	"context"
+	"time"
+)
+
+// Backoff describes an exponential backoff schedule: the wait before each retry is the previous
+// wait multiplied by Factor, capped at Max. With the zero value, Do retries every second until
+// fn succeeds or ctx is done.
+type Backoff struct {
+	// Initial is the wait before the first retry. Zero means one second.
+	Initial time.Duration
+
+	// Max caps the wait between retries. Zero means uncapped.
+	Max time.Duration
+
+	// Factor multiplies the wait after each retry. Zero (or less than one) means the wait never
+	// grows.
+	Factor float64
+
+	// Attempts bounds the total number of calls Do makes, including the first. Zero means retry
+	// until fn succeeds or ctx is done.
+	Attempts int
+}
+
+// Do calls fn until it returns nil, ctx is done, or b.Attempts is exhausted, sleeping according
+// to b's schedule between attempts. It returns the error from the last attempt, or ctx.Err() if
+// ctx ends the wait.
+func Do(ctx context.Context, b Backoff, fn func() error) error {
+	wait := b.Initial
+	if wait <= 0 {
+		wait = time.Second
+	}
+
+	var err error
+	for attempt := 1; b.Attempts == 0 || attempt <= b.Attempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+
+		if b.Attempts != 0 && attempt == b.Attempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		if b.Factor >= 1 {
+			wait = time.Duration(float64(wait) * b.Factor)
+		}
+		if b.Max > 0 && wait > b.Max {
+			wait = b.Max
+		}
+	}
+
+	return err
+}
@@ -1,39 +1,35 @@
 package satokensource
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/wkharold/fileup/pkg/sdlog"
 	"golang.org/x/oauth2"
-	iam "google.golang.org/api/iam/v1"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
 )
 
-type accessTokenClaimSet struct {
-	Iss   string `json:"iss"`
-	Scope string `json:"scope"`
-	Aud   string `json:"aud"`
-	Exp   int64  `json:"exp"`
-	Iat   int64  `json:"iat"`
-}
-
 // ServiceAccountTokenSource returns access tokens for the associated service account.
 type ServiceAccountTokenSource struct {
 	client         *http.Client
 	logger         *sdlog.StackdriverLogger
 	projectID      string
 	serviceAccount string
+
+	once  sync.Once
+	inner oauth2.TokenSource
+	err   error
 }
 
 const (
-	accessTokenTTL = 59
-	emptyRequest   = ""
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	maxRetries         = 3
 )
 
 var (
@@ -50,95 +46,77 @@ func New(client *http.Client, logger *sdlog.StackdriverLogger, projectID, servic
 	}
 }
 
-func createTokenRequest(client *http.Client, pid, sa string) (string, error) {
-	iamsvc, err := iam.New(client)
-	if err != nil {
-		return emptyRequest, err
-	}
+// newInner builds the impersonated token source client is authorized to mint tokens for
+// serviceAccount with, retrying transient (5xx) failures against the IAM Credentials endpoint.
+func newInner(client *http.Client, serviceAccount string) (oauth2.TokenSource, error) {
+	retrying := &http.Client{Transport: &retryTransport{base: client.Transport}}
 
-	tnow := time.Now()
+	return impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: serviceAccount,
+		Scopes:          []string{cloudPlatformScope},
+	}, option.WithHTTPClient(retrying))
+}
 
-	claims := &accessTokenClaimSet{
-		Aud:   "https://www.googleapis.com/oauth2/v4/token",
-		Exp:   tnow.Add(time.Duration(5) * time.Minute).Unix(),
-		Iat:   tnow.Unix(),
-		Iss:   sa,
-		Scope: iam.CloudPlatformScope,
+// Token returns an OAuth2 access token for the service account associated with this token
+// source. Tokens are cached and automatically refreshed once their expiration passes; Token is
+// safe to call concurrently.
+func (ts *ServiceAccountTokenSource) Token() (*oauth2.Token, error) {
+	ts.once.Do(func() {
+		ts.inner, ts.err = newInner(ts.client, ts.serviceAccount)
+	})
+	if ts.err != nil {
+		ts.logger.LogError("Impersonated token source creation failed", ts.err)
+		return nil, ts.err
 	}
 
-	bs, err := json.Marshal(claims)
+	tok, err := ts.inner.Token()
 	if err != nil {
-		return emptyRequest, err
+		ts.logger.LogError("Access token request failed", err)
+		return nil, err
 	}
 
-	psasvc := iam.NewProjectsServiceAccountsService(iamsvc)
-	jwtsigner := psasvc.SignJwt(
-		fmt.Sprintf("projects/%s/serviceAccounts/%s", pid, sa),
-		&iam.SignJwtRequest{Payload: string(bs)},
-	)
-
-	jwtsigner = jwtsigner.Context(ctx)
-
-	signerresp, err := jwtsigner.Do()
-	if err != nil {
-		return emptyRequest, err
-	}
+	ts.logger.LogInfo(fmt.Sprintf("Retrieved an OAuth2 access token for: %s", ts.serviceAccount))
 
-	return fmt.Sprintf("grant_type=%s&assertion=%s", url.QueryEscape("urn:ietf:params:oauth:grant-type:jwt-bearer"), url.QueryEscape(signerresp.SignedJwt)), nil
+	return tok, nil
 }
 
-func requestAccessToken(tokreq string) (*oauth2.Token, error) {
-	httpclient := &http.Client{}
-	req, err := http.NewRequest(
-		"POST",
-		"https://www.googleapis.com/oauth2/v4/token",
-		strings.NewReader(tokreq),
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := httpclient.Do(req)
-	if err != nil {
-		return nil, err
-	}
+// retryTransport retries requests to the IAM Credentials API that fail with a 5xx status,
+// backing off exponentially between attempts.
+type retryTransport struct {
+	base http.RoundTripper
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
 	}
 
-	var fields interface{}
-	err = json.Unmarshal(body, &fields)
-	if err != nil {
-		return nil, err
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
 	}
 
-	acctok := fields.(map[string]interface{})["access_token"]
-	if acctok == nil || len(acctok.(string)) == 0 {
-		return nil, fmt.Errorf("empty access token field")
-	}
+	var (
+		resp *http.Response
+		err  error
+	)
 
-	return &oauth2.Token{AccessToken: acctok.(string), Expiry: time.Now().Add(time.Duration(accessTokenTTL) * time.Minute)}, nil
-}
+	for attempt := 0; ; attempt++ {
+		resp, err = base.RoundTrip(req)
+		if err != nil || resp.StatusCode < http.StatusInternalServerError || attempt == maxRetries {
+			return resp, err
+		}
 
-// Token returns an OAuth2 access token for the service account associated with this token source.
-func (ts ServiceAccountTokenSource) Token() (*oauth2.Token, error) {
-	tokreq, err := createTokenRequest(ts.client, ts.projectID, ts.serviceAccount)
-	if err != nil {
-		ts.logger.LogError("Access token reqest creation failed", err)
-		return nil, err
-	}
+		resp.Body.Close()
+		time.Sleep(time.Duration(1<<uint(attempt)) * 100 * time.Millisecond)
 
-	tok, err := requestAccessToken(tokreq)
-	if err != nil {
-		ts.logger.LogError(fmt.Sprint("Access token request failed"), err)
-		return nil, err
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
 	}
-
-	ts.logger.LogInfo(fmt.Sprintf("Retrieved an OAuth2 access token for: %s", ts.serviceAccount))
-
-	return tok, nil
 }
@@ -0,0 +1,84 @@
+package satokensource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wkharold/fileup/pkg/sdlog"
+)
+
+// fakeRoundTripper simulates the IAM Credentials generateAccessToken endpoint. It always
+// returns an already-expired token so tests can assert that Token() goes back to the wire
+// for a new one instead of serving a stale, cached token.
+type fakeRoundTripper struct {
+	calls int
+}
+
+func (f *fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.calls++
+
+	bs, err := json.Marshal(map[string]string{
+		"accessToken": fmt.Sprintf("token-%d", f.calls),
+		"expireTime":  time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(string(bs))),
+	}, nil
+}
+
+func TestTokenRefreshesAfterExpiry(t *testing.T) {
+	rt := &fakeRoundTripper{}
+	client := &http.Client{Transport: rt}
+
+	ts := New(client, &sdlog.StackdriverLogger{}, "example-project", "svc@example-project.iam.gserviceaccount.com")
+
+	first, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token() returned an error: %+v", err)
+	}
+
+	second, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token() returned an error: %+v", err)
+	}
+
+	if first.AccessToken == second.AccessToken {
+		t.Fatalf("expected a refreshed token once Expiry passed, got %q both times", first.AccessToken)
+	}
+
+	if rt.calls < 2 {
+		t.Fatalf("expected the token endpoint to be called at least twice, got %d", rt.calls)
+	}
+}
+
+func TestFromConfigUnsupportedMode(t *testing.T) {
+	if _, err := FromConfig(context.Background(), Config{Mode: "bogus"}); err == nil {
+		t.Fatal("expected an error for an unsupported mode, got nil")
+	}
+}
+
+func TestFromConfigKeyFileModesRequireAKeyFile(t *testing.T) {
+	if old, ok := os.LookupEnv(googleApplicationCredentialsEnvVar); ok {
+		os.Unsetenv(googleApplicationCredentialsEnvVar)
+		defer os.Setenv(googleApplicationCredentialsEnvVar, old)
+	}
+
+	for _, mode := range []Mode{ModeJWTFile, ModeExternalAccount} {
+		if _, err := FromConfig(context.Background(), Config{Mode: mode}); err == nil {
+			t.Fatalf("%s: expected an error with no KeyFile and no %s set, got nil", mode, googleApplicationCredentialsEnvVar)
+		}
+	}
+}
@@ -1,16 +1,32 @@
+// Package sdlog provides a thin, structured wrapper over Stackdriver (Cloud)
+// Logging for the fileup microservices. Logger instances are cheap to
+// derive: WithFields binds fields (bucket, object, event id, ...) that are
+// merged into every subsequent entry, and WithTrace stamps entries with the
+// Cloud Trace trace/span ids of the request that triggered the work, so a
+// single upload can be filtered as one trace across receiver, recognizer,
+// labeler, archiver, and purger.
 package sdlog
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"strings"
 
 	"cloud.google.com/go/logging"
 )
 
+// A StackdriverLogger logs structured entries to a single Stackdriver log,
+// optionally binding a set of fields and a Cloud Trace trace/span id that
+// are attached to every entry logged through it.
 type StackdriverLogger struct {
 	logger *logging.Logger
+	trace  string
+	spanID string
+	fields map[string]interface{}
 }
 
+// Logger creates a StackdriverLogger that writes to logname in projectId.
 func Logger(projectId, logname string) (*StackdriverLogger, error) {
 	lc, err := logging.NewClient(context.Background(), projectId)
 	if err != nil {
@@ -24,26 +40,123 @@ func Logger(projectId, logname string) (*StackdriverLogger, error) {
 	return &StackdriverLogger{logger: lc.Logger(logname)}, nil
 }
 
-func (l StackdriverLogger) LogError(msg string, err error) {
+// WithFields returns a child logger that merges fields into every entry logged through it, in
+// addition to any fields already bound on l. The receiver is left unmodified.
+func (l StackdriverLogger) WithFields(fields map[string]interface{}) *StackdriverLogger {
+	merged := make(map[string]interface{}, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	child := l
+	child.fields = merged
+
+	return &child
+}
+
+// WithTrace returns a child logger that stamps every entry logged through it with the given
+// Cloud Trace trace (of the form "projects/{projectId}/traces/{traceId}") and span ids. The
+// receiver is left unmodified.
+func (l StackdriverLogger) WithTrace(trace, spanID string) *StackdriverLogger {
+	child := l
+	child.trace = trace
+	child.spanID = spanID
+
+	return &child
+}
+
+func (l StackdriverLogger) log(severity logging.Severity, msg string, fields map[string]interface{}) {
+	if l.logger == nil {
+		return
+	}
+
+	payload := make(map[string]interface{}, len(l.fields)+len(fields)+1)
+	payload["message"] = msg
+	for k, v := range l.fields {
+		payload[k] = v
+	}
+	for k, v := range fields {
+		payload[k] = v
+	}
+
 	l.logger.Log(logging.Entry{
-		Payload: struct {
-			Message string
-			Error   string
-		}{
-			Message: msg,
-			Error:   err.Error(),
-		},
-		Severity: logging.Error,
+		Payload:  payload,
+		Severity: severity,
+		Trace:    l.trace,
+		SpanID:   l.spanID,
 	})
 }
 
+// Debug logs msg at Debug severity with the given structured fields merged with any fields
+// bound via WithFields.
+func (l StackdriverLogger) Debug(msg string, fields map[string]interface{}) {
+	l.log(logging.Debug, msg, fields)
+}
+
+// Info logs msg at Info severity with the given structured fields merged with any fields bound
+// via WithFields.
+func (l StackdriverLogger) Info(msg string, fields map[string]interface{}) {
+	l.log(logging.Info, msg, fields)
+}
+
+// Warning logs msg at Warning severity with the given structured fields merged with any fields
+// bound via WithFields.
+func (l StackdriverLogger) Warning(msg string, fields map[string]interface{}) {
+	l.log(logging.Warning, msg, fields)
+}
+
+// Error logs msg and err at Error severity with the given structured fields merged with any
+// fields bound via WithFields.
+func (l StackdriverLogger) Error(msg string, err error, fields map[string]interface{}) {
+	merged := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		merged[k] = v
+	}
+	if err != nil {
+		merged["error"] = err.Error()
+	}
+
+	l.log(logging.Error, msg, merged)
+}
+
+// LogError is a thin wrapper over Error kept for backward compatibility.
+func (l StackdriverLogger) LogError(msg string, err error) {
+	l.Error(msg, err, nil)
+}
+
+// LogInfo is a thin wrapper over Info kept for backward compatibility.
 func (l StackdriverLogger) LogInfo(msg string) {
-	l.logger.Log(logging.Entry{
-		Payload: struct {
-			Message string
-		}{
-			Message: msg,
-		},
-		Severity: logging.Info,
-	})
+	l.Info(msg, nil)
+}
+
+// ParseCloudTraceContext extracts a Stackdriver-formatted trace name and span id from an
+// incoming request's X-Cloud-Trace-Context header, falling back to the W3C traceparent header
+// if the former is absent. It returns empty strings if neither header carries a trace id.
+func ParseCloudTraceContext(projectID, xCloudTraceContext, traceparent string) (trace, spanID string) {
+	if xCloudTraceContext != "" {
+		parts := strings.SplitN(xCloudTraceContext, "/", 2)
+
+		traceID := parts[0]
+		if traceID == "" {
+			return "", ""
+		}
+
+		if len(parts) > 1 {
+			spanID = strings.SplitN(parts[1], ";", 2)[0]
+		}
+
+		return fmt.Sprintf("projects/%s/traces/%s", projectID, traceID), spanID
+	}
+
+	if traceparent != "" {
+		parts := strings.Split(traceparent, "-")
+		if len(parts) >= 3 && parts[1] != "" {
+			return fmt.Sprintf("projects/%s/traces/%s", projectID, parts[1]), parts[2]
+		}
+	}
+
+	return "", ""
 }
@@ -0,0 +1,124 @@
+package tokensource
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/pkg/credentials"
+)
+
+const (
+	stsAction     = "AssumeRoleWithWebIdentity"
+	stsAPIVersion = "2011-06-15"
+
+	// stsAudience is the conventional STS web-identity audience; MinIO doesn't validate it
+	// beyond using it to select the configured identity provider.
+	stsAudience = "sts.amazonaws.com"
+
+	stsTokenTTL     = time.Hour
+	stsExpiryWindow = 30 * time.Second // refresh this long before Expiration to absorb clock skew
+)
+
+// MinIOSTSProvider is a minio-go credentials.Provider that exchanges a freshly signed web
+// identity JWT for scoped, short-lived S3 credentials from a MinIO STS endpoint, via
+// AssumeRoleWithWebIdentity (https://github.com/minio/minio/blob/master/docs/sts/web-identity.md).
+// Pass one to objectstore.NewMinIOWithSTS (or via objectstore.Config.MinIOSTSEndpoint) in
+// place of a static access/secret key pair so that no long-lived credential needs to be
+// provisioned into the pod at all.
+type MinIOSTSProvider struct {
+	endpoint string
+	signer   Signer
+	policy   string
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+// NewMinIOSTS creates a MinIOSTSProvider that calls the STS API at endpoint with JWTs from
+// signer, requesting credentials restricted by policy (a JSON IAM policy document, see
+// ActionPolicy; empty means whatever the server's default policy for the caller grants).
+func NewMinIOSTS(endpoint string, signer Signer, policy string) *MinIOSTSProvider {
+	return &MinIOSTSProvider{endpoint: endpoint, signer: signer, policy: policy}
+}
+
+// ActionPolicy returns the JSON IAM policy document that scopes a MinIOSTSProvider's
+// credentials to actions (e.g. "s3:GetObject") on bucket and the objects within it.
+func ActionPolicy(bucket string, actions ...string) string {
+	actionsJSON, _ := json.Marshal(actions)
+
+	return fmt.Sprintf(
+		`{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":%s,"Resource":["arn:aws:s3:::%s","arn:aws:s3:::%s/*"]}]}`,
+		actionsJSON, bucket, bucket,
+	)
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	XMLName xml.Name `xml:"AssumeRoleWithWebIdentityResponse"`
+	Result  struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"Credentials"`
+	} `xml:"AssumeRoleWithWebIdentityResult"`
+}
+
+// Retrieve satisfies credentials.Provider: it signs a fresh web identity JWT and exchanges it
+// for scoped credentials, recording their expiration for IsExpired.
+func (p *MinIOSTSProvider) Retrieve() (credentials.Value, error) {
+	jwt, err := p.signer.SignJWT(context.Background(), stsAudience, stsTokenTTL)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("unable to sign web identity token: %+v", err)
+	}
+
+	form := url.Values{
+		"Action":           {stsAction},
+		"Version":          {stsAPIVersion},
+		"WebIdentityToken": {jwt},
+		"DurationSeconds":  {fmt.Sprintf("%d", int(stsTokenTTL.Seconds()))},
+	}
+	if p.policy != "" {
+		form.Set("Policy", p.policy)
+	}
+
+	resp, err := http.PostForm(p.endpoint, form)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("unable to reach STS endpoint %s: %+v", p.endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return credentials.Value{}, fmt.Errorf("STS endpoint %s returned %s", p.endpoint, resp.Status)
+	}
+
+	var parsed assumeRoleWithWebIdentityResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return credentials.Value{}, fmt.Errorf("unable to parse STS response from %s: %+v", p.endpoint, err)
+	}
+
+	p.mu.Lock()
+	p.expires = parsed.Result.Credentials.Expiration
+	p.mu.Unlock()
+
+	return credentials.Value{
+		AccessKeyID:     parsed.Result.Credentials.AccessKeyID,
+		SecretAccessKey: parsed.Result.Credentials.SecretAccessKey,
+		SessionToken:    parsed.Result.Credentials.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+// IsExpired satisfies credentials.Provider.
+func (p *MinIOSTSProvider) IsExpired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.expires.IsZero() || time.Now().After(p.expires.Add(-stsExpiryWindow))
+}
@@ -0,0 +1,17 @@
+// Package tokensource lets a fileup microservice prove its GCP service account identity to a
+// non-GCP Security Token Service and exchange that proof for scoped, short-lived data-plane
+// credentials, instead of relying on a long-lived shared secret baked into the pod.
+package tokensource
+
+import (
+	"context"
+	"time"
+)
+
+// A Signer mints a JWT asserting the caller's GCP service account identity, scoped to
+// audience and valid for no longer than ttl. The JWT is self-contained and verifiable by
+// anyone who trusts Google's public JWKS, which is what lets a non-GCP STS endpoint accept it
+// as a web identity token without ever talking to Google itself.
+type Signer interface {
+	SignJWT(ctx context.Context, audience string, ttl time.Duration) (string, error)
+}
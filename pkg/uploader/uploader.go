@@ -0,0 +1,491 @@
+// Package uploader provides the constructor and HTTP handlers for the fileup upload microservice.
+// The upload microservice accepts image files from clients, either streamed directly through the
+// process or written straight to object storage via a presigned URL, and publishes an image
+// received message to its message bus topic once the object is confirmed in storage.
+package uploader
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wkharold/fileup/pkg/auth"
+	"github.com/wkharold/fileup/pkg/bus"
+	"github.com/wkharold/fileup/pkg/events"
+	"github.com/wkharold/fileup/pkg/objectstore"
+	"github.com/wkharold/fileup/pkg/retry"
+	"github.com/wkharold/fileup/pkg/sdlog"
+)
+
+// FileDesc describes an uploaded file returned to clients, optionally carrying a presigned
+// URL for direct download.
+type FileDesc struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	URL  string `json:"url,omitempty"`
+}
+
+// presignExpiry is how long a presigned PUT URL, and the upload token that accompanies it,
+// remain valid.
+const presignExpiry = 15 * time.Minute
+
+// commitLogSize bounds how many recently committed object keys an Uploader remembers for
+// ServeOrphans. It only needs to cover uploads since the process last restarted; the object
+// store itself remains the source of truth.
+const commitLogSize = 10000
+
+// defaultPublishRetry is the retry.Backoff New applies when its publishRetry argument is the
+// zero value: a handful of quick retries gives a transient Pub/Sub blip a chance to clear
+// before a failed publish triggers rollback.
+var defaultPublishRetry = retry.Backoff{Initial: time.Second, Max: 30 * time.Second, Factor: 2, Attempts: 5}
+
+// An Uploader accepts image upload requests via HTTP, either streamed directly through the
+// process or PUT straight to object storage by the client using a presigned URL. A message is
+// published on the uploader's topic for every image confirmed in storage.
+type Uploader struct {
+	bucket       string
+	logger       *sdlog.StackdriverLogger
+	store        objectstore.Store
+	sse          objectstore.SSEConfig
+	bus          bus.Publisher
+	topic        string
+	projectID    string
+	publishRetry retry.Backoff
+
+	mu      sync.Mutex
+	pending map[string]pendingUpload
+
+	commits *commitLog
+}
+
+// pendingUpload tracks the object an upload token was issued for, so ServeComplete knows
+// what to verify without trusting a client-supplied key.
+type pendingUpload struct {
+	key     string
+	expires time.Time
+}
+
+// commitLog is a bounded record of recently committed object keys, used by ServeOrphans to tell
+// a genuine orphan (its publish never succeeded) from an object this process simply hasn't
+// forgotten yet. It evicts the oldest key once full rather than growing without bound; it is not
+// persisted, so it only covers uploads since the process last started.
+type commitLog struct {
+	mu       sync.Mutex
+	keys     []string
+	index    map[string]bool
+	capacity int
+}
+
+func newCommitLog(capacity int) *commitLog {
+	return &commitLog{index: map[string]bool{}, capacity: capacity}
+}
+
+func (c *commitLog) record(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.index[key] {
+		return
+	}
+
+	if len(c.keys) >= c.capacity {
+		delete(c.index, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+
+	c.index[key] = true
+	c.keys = append(c.keys, key)
+}
+
+func (c *commitLog) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.index[key]
+}
+
+const (
+	noprefix = ""
+	source   = "fileup/uploader"
+)
+
+var (
+	ctx = context.Background()
+)
+
+// New creates and initializes an Uploader. It publishes image received notifications to topic
+// via b, so that the pipeline can run against any bus.Bus backend (Google PubSub, MQTT, ...).
+// sse additionally requests object-store-managed server-side encryption for directly streamed
+// uploads (sse.Mode may be SSENone to disable it); with any other mode, writes fail unless the
+// store implements objectstore.ServerSideEncryption.
+// projectID is used to format the Cloud Trace trace name stamped on log entries and propagated
+// downstream with the published event.
+// publishRetry governs how many times, and with what backoff, a failed publish is retried before
+// the object written to storage is rolled back; the zero value selects defaultPublishRetry.
+func New(store objectstore.Store, bucket string, logger *sdlog.StackdriverLogger, sse objectstore.SSEConfig, b bus.Publisher, topic, projectID string, publishRetry retry.Backoff) (*Uploader, error) {
+	if publishRetry == (retry.Backoff{}) {
+		publishRetry = defaultPublishRetry
+	}
+
+	return &Uploader{
+		bucket:       bucket,
+		logger:       logger,
+		store:        store,
+		sse:          sse,
+		bus:          b,
+		topic:        topic,
+		projectID:    projectID,
+		publishRetry: publishRetry,
+		pending:      map[string]pendingUpload{},
+		commits:      newCommitLog(commitLogSize),
+	}, nil
+}
+
+// put writes body's contents to object under u.bucket. With u.sse.Mode SSENone it does a plain
+// Put; with any other mode it applies u.sse, returning an error if the underlying store does
+// not support objectstore.ServerSideEncryption.
+func (u *Uploader) put(object string, body io.Reader) error {
+	if u.sse.Mode == objectstore.SSENone {
+		return u.store.Put(ctx, u.bucket, object, body, "application/octet-stream", nil)
+	}
+
+	sse, ok := u.store.(objectstore.ServerSideEncryption)
+	if !ok {
+		return fmt.Errorf("object store does not support server-side encryption")
+	}
+
+	return sse.PutEncrypted(ctx, u.bucket, object, body, "application/octet-stream", nil, u.sse)
+}
+
+// ServeHTTP handles receiving an image file in the request body and writing it directly to
+// object storage. Once the file is saved an image received message is published to the
+// uploader's topic.
+func (u *Uploader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	trace, spanID := sdlog.ParseCloudTraceContext(u.projectID, req.Header.Get("X-Cloud-Trace-Context"), req.Header.Get("traceparent"))
+	logger := u.logger.WithTrace(trace, spanID)
+
+	file, header, err := req.FormFile("file")
+	if err != nil {
+		msg := fmt.Sprint("Unable to extract file contents from request")
+
+		logger.LogError(msg, err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s [%+v]", msg, err)
+		return
+	}
+	defer file.Close()
+
+	logger = logger.WithFields(map[string]interface{}{"bucket": u.bucket, "object": header.Filename})
+
+	if err = u.put(header.Filename, file); err != nil {
+		msg := fmt.Sprintf("File upload failed")
+
+		logger.LogError(msg, err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s [%+v]", msg, err)
+		return
+	}
+
+	user, _ := auth.User(req)
+
+	if _, err := u.commit(logger, header.Filename, header.Size, user, trace, spanID); err != nil {
+		if rb, ok := err.(errRolledBack); ok {
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "upload failed, safe to retry: %+v\n", rb.cause)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Received notification failed: %+v", err)
+		return
+	}
+
+	fmt.Fprintf(w, "File %s uploaded successfully.\n", header.Filename)
+}
+
+// ServePresign returns a short-lived presigned PUT URL for the object named by the "name"
+// query parameter, together with an opaque upload token the client presents to ServeComplete
+// once the PUT finishes. Clients that use this path never send file contents through the
+// uploader process.
+func (u *Uploader) ServePresign(w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("name")
+	if len(name) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "name query parameter is required")
+		return
+	}
+
+	url, err := u.store.Presign(ctx, u.bucket, name, objectstore.PresignPut, presignExpiry)
+	if err != nil {
+		u.logger.LogError(fmt.Sprintf("Unable to presign %s/%s", u.bucket, name), err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Unable to presign upload: %+v", err)
+		return
+	}
+
+	token := uuid.New().String()
+
+	u.mu.Lock()
+	u.pending[token] = pendingUpload{key: name, expires: time.Now().Add(presignExpiry)}
+	u.mu.Unlock()
+
+	writeJSON(w, struct {
+		URL   string `json:"url"`
+		Token string `json:"token"`
+	}{URL: url, Token: token})
+}
+
+// ServeComplete verifies that the object named by a prior ServePresign call reached object
+// storage, publishes the image received notification, and returns its FileDesc. token must be
+// one issued by ServePresign and not yet completed.
+func (u *Uploader) ServeComplete(w http.ResponseWriter, req *http.Request) {
+	trace, spanID := sdlog.ParseCloudTraceContext(u.projectID, req.Header.Get("X-Cloud-Trace-Context"), req.Header.Get("traceparent"))
+	logger := u.logger.WithTrace(trace, spanID)
+
+	token := req.URL.Query().Get("token")
+
+	u.mu.Lock()
+	pu, ok := u.pending[token]
+	delete(u.pending, token)
+	u.mu.Unlock()
+
+	if !ok || time.Now().After(pu.expires) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "unknown or expired upload token")
+		return
+	}
+
+	logger = logger.WithFields(map[string]interface{}{"bucket": u.bucket, "object": pu.key})
+
+	info, err := u.store.Stat(ctx, u.bucket, pu.key)
+	if err != nil {
+		msg := fmt.Sprintf("Presigned upload for %s/%s did not complete", u.bucket, pu.key)
+
+		logger.LogError(msg, err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s [%+v]", msg, err)
+		return
+	}
+
+	user, _ := auth.User(req)
+
+	if _, err := u.commit(logger, pu.key, info.Size, user, trace, spanID); err != nil {
+		if rb, ok := err.(errRolledBack); ok {
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "upload failed, safe to retry: %+v\n", rb.cause)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Received notification failed: %+v", err)
+		return
+	}
+
+	writeJSON(w, FileDesc{Name: pu.key, Size: info.Size})
+}
+
+// ServeUploaded lists the objects in the upload bucket, each with a presigned GET URL so
+// consumers can download them without proxying through the uploader.
+func (u *Uploader) ServeUploaded(w http.ResponseWriter, req *http.Request) {
+	objs, err := u.store.List(ctx, u.bucket, noprefix)
+	if err != nil {
+		u.logger.LogError(fmt.Sprintf("Problem listing contents of bucket %s", u.bucket), err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]FileDesc, 0, len(objs))
+	for _, obj := range objs {
+		url, err := u.store.Presign(ctx, u.bucket, obj.Key, objectstore.PresignGet, presignExpiry)
+		if err != nil {
+			u.logger.LogError(fmt.Sprintf("Unable to presign %s/%s", u.bucket, obj.Key), err)
+			continue
+		}
+
+		result = append(result, FileDesc{Name: obj.Key, Size: obj.Size, URL: url})
+	}
+
+	writeJSON(w, result)
+}
+
+// ServeOrphans lists objects in the upload bucket that this process has no record of
+// successfully publishing a notification for, i.e. uploads whose commit may have rolled back
+// because the compensating delete itself failed. It's an admin operation, expected behind the
+// same auth.Middleware as the rest of the upload endpoints. The commit log only covers uploads
+// since this process started, so a restart makes every existing object look orphaned until it's
+// re-committed; treat this endpoint as a hint, not an authoritative audit.
+func (u *Uploader) ServeOrphans(w http.ResponseWriter, req *http.Request) {
+	objs, err := u.store.List(ctx, u.bucket, noprefix)
+	if err != nil {
+		u.logger.LogError(fmt.Sprintf("Problem listing contents of bucket %s", u.bucket), err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	orphans := make([]FileDesc, 0)
+	for _, obj := range objs {
+		if !u.commits.has(obj.Key) {
+			orphans = append(orphans, FileDesc{Name: obj.Key, Size: obj.Size})
+		}
+	}
+
+	writeJSON(w, orphans)
+}
+
+// rotateKeyRequest is the body ServeRotateKey expects: the new server-side encryption to apply
+// to every object in the bucket. NewCustomerKey, present only for NewMode "sse-c", is
+// base64-encoded so it never appears in a URL or access log.
+type rotateKeyRequest struct {
+	NewMode        string `json:"newMode"`
+	NewKMSKeyID    string `json:"newKmsKeyId,omitempty"`
+	NewCustomerKey string `json:"newCustomerKey,omitempty"`
+}
+
+// ServeRotateKey re-encrypts every object in the upload bucket in place under a new
+// server-side encryption key, via the store's CopyObject-based RotateKey. It's an admin
+// operation: callers are expected to put it behind the same auth.Middleware as the rest of the
+// upload endpoints. u's own server-side encryption configuration is left unchanged; operators
+// should redeploy the uploader with the new --sse-mode flags once rotation completes so future
+// uploads use the new key too.
+func (u *Uploader) ServeRotateKey(w http.ResponseWriter, req *http.Request) {
+	sse, ok := u.store.(objectstore.ServerSideEncryption)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintln(w, "object store does not support server-side encryption")
+		return
+	}
+
+	var body rotateKeyRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "unable to decode request body: %+v", err)
+		return
+	}
+
+	newSSE := objectstore.SSEConfig{Mode: objectstore.SSEMode(body.NewMode), KMSKeyID: body.NewKMSKeyID}
+	if newSSE.Mode == objectstore.SSEC {
+		key, err := base64.StdEncoding.DecodeString(body.NewCustomerKey)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "unable to decode newCustomerKey: %+v", err)
+			return
+		}
+		newSSE.CustomerKey = key
+	}
+
+	objs, err := u.store.List(ctx, u.bucket, noprefix)
+	if err != nil {
+		u.logger.LogError(fmt.Sprintf("Problem listing contents of bucket %s", u.bucket), err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rotated := 0
+	for _, obj := range objs {
+		if err := sse.RotateKey(ctx, u.bucket, obj.Key, u.sse, newSSE); err != nil {
+			u.logger.LogError(fmt.Sprintf("Key rotation failed for %s/%s", u.bucket, obj.Key), err)
+			continue
+		}
+		rotated++
+	}
+
+	fmt.Fprintf(w, "Rotated encryption key for %d/%d objects in %s.\n", rotated, len(objs), u.bucket)
+}
+
+// notify publishes an image received event for key/size to u's topic, stamped with trace/spanID.
+// user is the authenticated uploader (see auth.User), or empty if auth is disabled.
+func (u *Uploader) notify(key string, size int64, user, trace, spanID string) (string, error) {
+	return events.PublishWithTrace(ctx, u.bus, u.topic, events.TypeImageReceived, source, events.ImageData{
+		Bucket:   u.bucket,
+		Object:   key,
+		Size:     size,
+		Uploader: user,
+	}, trace, spanID)
+}
+
+// errRolledBack indicates a commit's publish failed and its compensating delete succeeded: the
+// object is gone and the client never received a notification, so the whole upload is safe to
+// retry from scratch.
+type errRolledBack struct {
+	cause error
+}
+
+func (e errRolledBack) Error() string {
+	return fmt.Sprintf("upload rolled back: %+v", e.cause)
+}
+
+// transaction records compensating actions for a saga-style commit: if a downstream step fails
+// after the object is already in storage, rollback undoes it so no orphan is left behind.
+type transaction struct {
+	compensations []func() error
+}
+
+// onRollback appends a compensating action, run by rollback in reverse order of registration.
+func (t *transaction) onRollback(fn func() error) {
+	t.compensations = append(t.compensations, fn)
+}
+
+// rollback runs every compensating action in reverse order, returning the first error
+// encountered. A non-nil return means a compensation itself failed and the object it was meant
+// to remove is now an orphan.
+func (t *transaction) rollback() error {
+	for i := len(t.compensations) - 1; i >= 0; i-- {
+		if err := t.compensations[i](); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commit publishes the image received notification for key/size, attributed to user (empty if
+// auth is disabled), retrying transient failures per u.publishRetry, and rolls the upload back
+// (removing key from u.bucket) if every retry is exhausted. logger should already carry the
+// request's trace and bucket/object fields.
+func (u *Uploader) commit(logger *sdlog.StackdriverLogger, key string, size int64, user, trace, spanID string) (string, error) {
+	tx := &transaction{}
+	tx.onRollback(func() error { return u.store.Remove(ctx, u.bucket, key) })
+
+	var id string
+	pubErr := retry.Do(ctx, u.publishRetry, func() error {
+		var err error
+		id, err = u.notify(key, size, user, trace, spanID)
+		return err
+	})
+	if pubErr != nil {
+		if rbErr := tx.rollback(); rbErr != nil {
+			logger.Error("upload.orphan_detected", rbErr, nil)
+			return "", fmt.Errorf("publish to %s failed and rollback of %s/%s failed, object is orphaned: %+v", u.topic, u.bucket, key, pubErr)
+		}
+
+		logger.Info("upload.rolled_back", nil)
+		return "", errRolledBack{cause: pubErr}
+	}
+
+	u.commits.record(key)
+	logger.Info("upload.committed", map[string]interface{}{"eventID": id})
+
+	return id, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
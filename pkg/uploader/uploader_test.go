@@ -0,0 +1,93 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/wkharold/fileup/pkg/blob"
+	"github.com/wkharold/fileup/pkg/bus"
+	"github.com/wkharold/fileup/pkg/objectstore"
+	"github.com/wkharold/fileup/pkg/retry"
+	"github.com/wkharold/fileup/pkg/sdlog"
+)
+
+// fakePublisher records every Publish call so tests can assert on what an Uploader sent, and
+// can be told to fail so tests can exercise the rollback path.
+type fakePublisher struct {
+	mu       sync.Mutex
+	fail     bool
+	attempts int
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, topic string, data []byte, attrs map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.attempts++
+	if f.fail {
+		return fmt.Errorf("publish to %s failed", topic)
+	}
+
+	return nil
+}
+
+const bucket = "uploads"
+
+func newUploader(t *testing.T, pub bus.Publisher) (*Uploader, *blob.MemStore) {
+	t.Helper()
+
+	store := blob.NewMemStore()
+
+	u, err := New(store, bucket, &sdlog.StackdriverLogger{}, objectstore.SSEConfig{}, pub, "image", "example-project", retry.Backoff{Initial: 0, Max: 0, Factor: 1, Attempts: 1})
+	if err != nil {
+		t.Fatalf("New() returned an error: %+v", err)
+	}
+
+	return u, store
+}
+
+func TestCommitPublishesAndRecordsTheObject(t *testing.T) {
+	pub := &fakePublisher{}
+	u, store := newUploader(t, pub)
+
+	if err := store.Put(ctx, bucket, "cat.png", bytes.NewReader([]byte("image bytes")), "image/png", nil); err != nil {
+		t.Fatalf("Put() returned an error: %+v", err)
+	}
+
+	if _, err := u.commit(&sdlog.StackdriverLogger{}, "cat.png", 11, "alice", "trace", "span"); err != nil {
+		t.Fatalf("commit() returned an error: %+v", err)
+	}
+
+	if pub.attempts != 1 {
+		t.Fatalf("expected exactly one publish attempt, got %d", pub.attempts)
+	}
+
+	if !u.commits.has("cat.png") {
+		t.Fatal("expected cat.png to be recorded in the commit log")
+	}
+}
+
+func TestCommitRollsBackOnPermanentPublishFailure(t *testing.T) {
+	pub := &fakePublisher{fail: true}
+	u, store := newUploader(t, pub)
+
+	if err := store.Put(ctx, bucket, "cat.png", bytes.NewReader([]byte("image bytes")), "image/png", nil); err != nil {
+		t.Fatalf("Put() returned an error: %+v", err)
+	}
+
+	_, err := u.commit(&sdlog.StackdriverLogger{}, "cat.png", 11, "alice", "trace", "span")
+	if _, ok := err.(errRolledBack); !ok {
+		t.Fatalf("expected errRolledBack, got %T: %+v", err, err)
+	}
+
+	if _, statErr := store.Stat(ctx, bucket, "cat.png"); statErr == nil {
+		t.Fatal("expected the rolled-back object to have been removed from the store")
+	}
+
+	if u.commits.has("cat.png") {
+		t.Fatal("a rolled-back object should not be recorded as committed")
+	}
+}
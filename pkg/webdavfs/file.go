@@ -0,0 +1,107 @@
+package webdavfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+)
+
+// file is the webdav.File returned by FS.OpenFile. Reads are served from a buffer fetched up
+// front since objectstore.Store.Get only returns an io.ReadCloser; writes accumulate in a
+// buffer and are flushed to the store on Close, since Store.Put needs the final size and
+// content up front.
+type file struct {
+	fs       *FS
+	ctx      context.Context
+	key      string
+	writable bool
+
+	info     os.FileInfo
+	entries  []os.FileInfo
+	contents []byte
+	off      int64
+
+	buf bytes.Buffer
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.writable {
+		return 0, os.ErrInvalid
+	}
+
+	if f.off >= int64(len(f.contents)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.contents[f.off:])
+	f.off += int64(n)
+
+	return n, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if !f.writable {
+		return 0, os.ErrInvalid
+	}
+
+	return f.buf.Write(p)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		f.off = offset
+	case io.SeekCurrent:
+		f.off += offset
+	case io.SeekEnd:
+		f.off = int64(len(f.contents)) + offset
+	default:
+		return 0, os.ErrInvalid
+	}
+
+	return f.off, nil
+}
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+
+	return entries, nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	if f.info != nil {
+		return f.info, nil
+	}
+
+	return f.fs.Stat(f.ctx, f.key)
+}
+
+func (f *file) Close() error {
+	if !f.writable {
+		return nil
+	}
+
+	contentType := "application/octet-stream"
+
+	if err := f.fs.store.Put(f.ctx, f.fs.bucket, f.key, bytes.NewReader(f.buf.Bytes()), contentType, nil); err != nil {
+		return err
+	}
+
+	return f.fs.notify(f.key, int64(f.buf.Len()))
+}
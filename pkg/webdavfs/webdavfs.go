@@ -0,0 +1,246 @@
+// Package webdavfs adapts an objectstore.Store to golang.org/x/net/webdav.FileSystem so the
+// fileup upload bucket can be mounted directly by WebDAV clients (macOS Finder, Windows
+// Explorer, rclone, ...) alongside the HTTP upload API in pkg/uploader.
+//
+// Object stores are flat key/value namespaces, so directories are synthesized: a directory is
+// any key prefix that either has a zero-byte marker object ending in "/" (created by Mkdir) or
+// is the common prefix of other objects.
+package webdavfs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wkharold/fileup/pkg/bus"
+	"github.com/wkharold/fileup/pkg/events"
+	"github.com/wkharold/fileup/pkg/objectstore"
+	"github.com/wkharold/fileup/pkg/sdlog"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	dirContentType = "application/x-directory"
+	source         = "fileup/webdav"
+)
+
+// FS is a webdav.FileSystem backed by a single bucket of an objectstore.Store. Files written
+// via PUT are published as image received events on topic, via b, so the recognizer/archiver/
+// purger pipeline runs over WebDAV uploads exactly as it does over pkg/uploader uploads.
+type FS struct {
+	store  objectstore.Store
+	bucket string
+	logger *sdlog.StackdriverLogger
+	bus    bus.Publisher
+	topic  string
+}
+
+// New creates an FS rooted at bucket. Uploaded files are announced to topic via b.
+func New(store objectstore.Store, bucket string, logger *sdlog.StackdriverLogger, b bus.Publisher, topic string) (*FS, error) {
+	return &FS{store: store, bucket: bucket, logger: logger, bus: b, topic: topic}, nil
+}
+
+func key(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Mkdir creates a zero-byte marker object so the directory shows up even before it holds any
+// files, satisfying webdav.FileSystem.
+func (fs *FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	k := key(name)
+	if len(k) == 0 {
+		return os.ErrExist
+	}
+
+	return fs.store.Put(ctx, fs.bucket, k+"/", strings.NewReader(""), dirContentType, nil)
+}
+
+// OpenFile opens name for reading or, with os.O_CREATE, for writing, satisfying
+// webdav.FileSystem.
+func (fs *FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	k := key(name)
+
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return &file{fs: fs, ctx: ctx, key: k, writable: true}, nil
+	}
+
+	if len(k) == 0 {
+		entries, err := fs.readdir(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		return &file{fs: fs, ctx: ctx, key: k, info: dirInfo(""), entries: entries}, nil
+	}
+
+	info, err := fs.Stat(ctx, name)
+	if err != nil {
+		if flag&os.O_CREATE != 0 {
+			return &file{fs: fs, ctx: ctx, key: k, writable: true}, nil
+		}
+		return nil, err
+	}
+
+	if info.IsDir() {
+		entries, err := fs.readdir(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		return &file{fs: fs, ctx: ctx, key: k, info: info, entries: entries}, nil
+	}
+
+	rc, err := fs.store.Get(ctx, fs.bucket, k)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	bs, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &file{fs: fs, ctx: ctx, key: k, info: info, contents: bs}, nil
+}
+
+// RemoveAll removes name; if name is a directory marker its contents are removed first,
+// satisfying webdav.FileSystem.
+func (fs *FS) RemoveAll(ctx context.Context, name string) error {
+	k := key(name)
+
+	infos, err := fs.store.List(ctx, fs.bucket, k+"/")
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if err := fs.store.Remove(ctx, fs.bucket, info.Key); err != nil {
+			return err
+		}
+	}
+
+	if err := fs.store.Remove(ctx, fs.bucket, k); err != nil && len(infos) == 0 {
+		return err
+	}
+
+	return nil
+}
+
+// Rename copies oldName to newName and removes oldName, satisfying webdav.FileSystem; this is
+// what WebDAV's MOVE method maps to.
+func (fs *FS) Rename(ctx context.Context, oldName, newName string) error {
+	oldKey, newKey := key(oldName), key(newName)
+
+	if err := fs.store.Copy(ctx, fs.bucket, oldKey, fs.bucket, newKey); err != nil {
+		return err
+	}
+
+	return fs.store.Remove(ctx, fs.bucket, oldKey)
+}
+
+// Stat returns the os.FileInfo for name, satisfying webdav.FileSystem.
+func (fs *FS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	k := key(name)
+	if len(k) == 0 {
+		return dirInfo(""), nil
+	}
+
+	if info, err := fs.store.Stat(ctx, fs.bucket, k); err == nil {
+		return fileInfo{name: path.Base(k), size: info.Size, modTime: info.LastModified}, nil
+	}
+
+	infos, err := fs.store.List(ctx, fs.bucket, k+"/")
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	return dirInfo(path.Base(k)), nil
+}
+
+// readdir lists the immediate children of the directory named by prefix, synthesizing
+// subdirectories from the common prefixes of deeper keys.
+func (fs *FS) readdir(ctx context.Context, prefix string) ([]os.FileInfo, error) {
+	listPrefix := prefix
+	if len(listPrefix) > 0 {
+		listPrefix += "/"
+	}
+
+	infos, err := fs.store.List(ctx, fs.bucket, listPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]os.FileInfo{}
+	for _, info := range infos {
+		rel := strings.TrimPrefix(info.Key, listPrefix)
+		if len(rel) == 0 {
+			continue
+		}
+
+		if i := strings.IndexByte(rel, '/'); i >= 0 {
+			name := rel[:i]
+			if _, ok := seen[name]; !ok {
+				seen[name] = dirInfo(name)
+			}
+			continue
+		}
+
+		seen[rel] = fileInfo{name: rel, size: info.Size, modTime: info.LastModified}
+	}
+
+	entries := make([]os.FileInfo, 0, len(seen))
+	for _, info := range seen {
+		entries = append(entries, info)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
+
+// notify publishes an image received event for key/size, mirroring the notification
+// uploader.ServeHTTP sends for uploads that arrive over HTTP.
+func (fs *FS) notify(k string, size int64) error {
+	_, err := events.Publish(context.Background(), fs.bus, fs.topic, events.TypeImageReceived, source, events.ImageData{
+		Bucket: fs.bucket,
+		Object: k,
+		Size:   size,
+	})
+	if err != nil {
+		fs.logger.LogError(fmt.Sprintf("Received notification failed for topic %s", fs.topic), err)
+	}
+	return err
+}
+
+// fileInfo is the os.FileInfo implementation returned for both plain objects and the
+// synthesized directories readdir/Stat produce.
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func dirInfo(name string) fileInfo {
+	return fileInfo{name: name, modTime: time.Now(), dir: true}
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return fi.dir }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+func (fi fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}